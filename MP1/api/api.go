@@ -0,0 +1,245 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"mvdan.cc/sh/v3/shell"
+
+	"gb4/grep"
+	"gb4/logtime"
+)
+
+// typed query sent to VM.Search
+type GrepRequest struct {
+	Pattern  string
+	Options  grep.Options
+	Sources  []string // named log sources configured on the server
+	Files    []string // extra files to search; with no sources or files the server's defaults are used
+	MaxLines int      // cap on lines returned, 0 means unlimited
+
+	// only lines with timestamps inside [Since, Until] are searched, zero means unbounded
+	Since time.Time
+	Until time.Time
+	// how the server finds timestamps, see logtime.NewParser; empty uses logtime.Default
+	TimeLayouts []string
+
+	// presented to servers with an access policy, see config.Access
+	Token string
+
+	// identifies the query for VM.Cancel, generated by the server if empty
+	QueryID string
+	// how long the server may work on the query, 0 uses the server default
+	Timeout time.Duration
+}
+
+// a single line returned by the server
+type Match struct {
+	Source  string // named source the file belongs to, empty for explicit files
+	File    string
+	Line    int
+	Offset  int64 // byte offset of the start of the line
+	Text    string
+	Context bool // true for -A/-B/-C context lines
+}
+
+// typed result of VM.Search
+// failures are reported in Status rather than as an RPC error, with whatever
+// was found before the failure still in the reply
+type GrepReply struct {
+	Status
+	Matches   []Match
+	Files     []string       // files that were searched, in order
+	Counts    map[string]int // matching lines per file
+	Errors    []string       // files that could not be searched
+	Total     int            // matching lines across all files, including truncated ones
+	Truncated bool           // true if MaxLines cut the result short
+	Hostname  string
+	Elapsed   time.Duration
+}
+
+// reply to VM.Open, identifies the query for VM.Next and VM.Close
+// a query that could not be started has no id and says why in Status
+type OpenReply struct {
+	Status
+	QueryID  string
+	Files    []string // files that will be searched, in order
+	Hostname string
+}
+
+// asks VM.Next for the next batch of an open query
+type NextRequest struct {
+	QueryID  string
+	MaxLines int // batch size, 0 uses the server default
+}
+
+// one page of results from VM.Next
+type Batch struct {
+	Matches []Match
+	Done    bool      // no more batches follow, the query is closed
+	Summary GrepReply // totals, counts, errors and status without lines, set once Done
+}
+
+// reply to VM.Status, also served as JSON on /healthz and /readyz
+type ServerStatus struct {
+	Version  string
+	Hostname string
+	Started  time.Time
+	Uptime   time.Duration
+	Sources  []SourceStatus
+
+	// current load
+	Running int        // queries running, streaming ones included
+	Queued  int        // queries waiting for a slot to run in
+	Streams int        // streaming queries open
+	LoadAvg [3]float64 // 1, 5 and 15 minute system load, zero where unknown
+
+	Ready    bool     // every source has a file that can be read
+	Problems []string // why the server is not ready
+}
+
+// one configured log source and its files
+type SourceStatus struct {
+	Name     string
+	Files    []FileStatus
+	Readable bool // at least one file can be opened
+}
+
+type FileStatus struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Err     string // why the file cannot be read, empty if it can
+}
+
+// returns a random id for a new query
+func NewQueryID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// builds a request from a command line such as grep -n "pattern" file
+// sources are picked with --source NAME (or --source=NAME), which may be repeated
+// --since and --until limit the search to a time range, see logtime.ParseBound
+// --token TOKEN presents a token to servers with an access policy
+func ParseCommand(cmd string) (GrepRequest, error) {
+	tokens, err := shell.Fields(cmd, nil)
+	if err != nil {
+		return GrepRequest{}, err
+	}
+	if err := Validate(tokens); err != nil {
+		return GrepRequest{}, err
+	}
+
+	var req GrepRequest
+	taken := make([]bool, len(tokens))
+	now := time.Now()
+	err = readFlags(tokens, func(f cmdFlag) error {
+		switch f.name {
+		case "source":
+			req.Sources = append(req.Sources, f.value)
+		case "token":
+			req.Token = f.value
+		case "since", "until":
+			t, err := logtime.ParseBound(f.value, now)
+			if err != nil {
+				return fmt.Errorf("error: --%s: %v", f.name, err)
+			}
+			if f.name == "since" {
+				req.Since = t
+			} else {
+				req.Until = t
+			}
+		default:
+			return nil
+		}
+		for i := f.at; i < f.next; i++ {
+			taken[i] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return GrepRequest{}, err
+	}
+	// the rest is grep's
+	var args []string
+	for i := 1; i < len(tokens); i++ {
+		if !taken[i] {
+			args = append(args, tokens[i])
+		}
+	}
+	if !req.Since.IsZero() && !req.Until.IsZero() && req.Until.Before(req.Since) {
+		return GrepRequest{}, errors.New("error: --until is before --since")
+	}
+
+	opts, pattern, files, err := grep.ParseArgs(args)
+	if err != nil {
+		return GrepRequest{}, err
+	}
+	req.Pattern, req.Options, req.Files = pattern, opts, files
+	return req, nil
+}
+
+// renders the reply the way grep would print it
+// file names are only shown when more than one file was searched
+func (r *GrepReply) Text(opts grep.Options) string {
+	if opts.Count {
+		return r.CountText()
+	}
+	f := Formatter{Options: opts, Multi: len(r.Files) > 1}
+	return strings.TrimSuffix(f.Format(r.Matches), "\n")
+}
+
+// renders per-file counts the way grep -c prints them
+func (r *GrepReply) CountText() string {
+	var b strings.Builder
+	for _, file := range r.Files {
+		count, ok := r.Counts[file]
+		if !ok {
+			continue
+		}
+		if len(r.Files) > 1 {
+			b.WriteString(file + ":")
+		}
+		b.WriteString(strconv.Itoa(count) + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// renders matches in grep's output format as they arrive, batch by batch
+type Formatter struct {
+	Options grep.Options
+	Multi   bool // prefix lines with their file name
+
+	prev    Match
+	started bool
+}
+
+// returns the lines for a batch, each terminated by a newline
+func (f *Formatter) Format(matches []Match) string {
+	contextual := f.Options.Before > 0 || f.Options.After > 0
+	var b strings.Builder
+
+	for _, m := range matches {
+		// separate non-adjacent context groups like grep does
+		if contextual && f.started && (f.prev.File != m.File || m.Line > f.prev.Line+1) {
+			b.WriteString("--\n")
+		}
+		f.prev = m
+		f.started = true
+
+		label := ""
+		if f.Multi {
+			label = m.File
+		}
+		line := grep.Line{Number: m.Line, Offset: m.Offset, Text: m.Text, Context: m.Context}
+		b.WriteString(grep.FormatLine(label, line, f.Options.LineNumbers) + "\n")
+	}
+	return b.String()
+}
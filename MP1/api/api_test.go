@@ -0,0 +1,61 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"gb4/grep"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		cmd     string
+		pattern string
+		opts    grep.Options
+		sources []string
+		files   []string
+		token   string
+		err     bool
+	}{
+		{cmd: "grep foo", pattern: "foo"},
+		{cmd: "grep -n foo a.log", pattern: "foo", opts: grep.Options{LineNumbers: true}, files: []string{"a.log"}},
+		{cmd: "grep --source app --source=web foo", pattern: "foo", sources: []string{"app", "web"}},
+		{cmd: "grep --token s3cret -i foo", pattern: "foo", opts: grep.Options{IgnoreCase: true}, token: "s3cret"},
+		{cmd: "grep -nA3 --source app foo", pattern: "foo", opts: grep.Options{LineNumbers: true, After: 3}, sources: []string{"app"}},
+		// option values are never taken for options of their own
+		{cmd: "grep -e --source log", pattern: "--source", files: []string{"log"}},
+		{cmd: "grep -e--token foo", pattern: "--token", files: []string{"foo"}},
+		{cmd: "grep --regexp --since x", pattern: "--since", files: []string{"x"}},
+		{cmd: "grep --regexp=--until foo", pattern: "--until", files: []string{"foo"}},
+		{cmd: "grep -- --source app", pattern: "--source", files: []string{"app"}},
+		{cmd: "grep --source app -e --token", pattern: "--token", sources: []string{"app"}},
+		{cmd: "grep foo --source", err: true},
+		{cmd: "grep --since yesterday-ish foo", err: true},
+		{cmd: "grep -r foo", err: true},
+		{cmd: "ls foo", err: true},
+	}
+	for _, tt := range tests {
+		req, err := ParseCommand(tt.cmd)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseCommand(%q) succeeded, want an error", tt.cmd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCommand(%q): %v", tt.cmd, err)
+			continue
+		}
+		if req.Pattern != tt.pattern || req.Options != tt.opts || req.Token != tt.token ||
+			!sameStrings(req.Sources, tt.sources) || !sameStrings(req.Files, tt.files) {
+			t.Errorf("ParseCommand(%q) = pattern %q, %+v, sources %q, files %q, token %q; want %q, %+v, %q, %q, %q",
+				tt.cmd, req.Pattern, req.Options, req.Sources, req.Files, req.Token,
+				tt.pattern, tt.opts, tt.sources, tt.files, tt.token)
+		}
+	}
+}
+
+// nil and empty are the same list
+func sameStrings(a, b []string) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
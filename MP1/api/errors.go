@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// what kind of outcome a request had, carried in replies so clients can branch
+// on it instead of matching error strings
+type Code string
+
+const (
+	CodeOK            Code = ""               // the query ran and something matched
+	CodeNoMatch       Code = "no_match"       // the query ran and nothing matched, not a failure
+	CodeInvalidQuery  Code = "invalid_query"  // bad flags, pattern, file or time range, rejected before running
+	CodeSourceMissing Code = "source_missing" // an unknown source, or none of the files could be read
+	CodeDenied        Code = "denied"         // the token does not allow this source or flag
+	CodeTimeout       Code = "timeout"        // the query hit its deadline, results are partial
+	CodeCancelled     Code = "cancelled"      // the query was stopped by VM.Cancel or VM.Close
+	CodeOverloaded    Code = "overloaded"     // the server turned the query away or is shutting down, try again later
+	CodeLimit         Code = "limit"          // the query read more than the server allows, results are partial
+	CodeRateLimited   Code = "rate_limited"   // the caller sent too many queries, try again after RetryAfter
+	CodeInternal      Code = "internal"       // anything else
+
+	// set by the client for nodes it could not reach, servers never send it
+	CodeUnavailable Code = "unavailable"
+)
+
+// reports whether a reply with this code holds a complete answer
+func (c Code) OK() bool {
+	return c == CodeOK || c == CodeNoMatch
+}
+
+// an error with a code, as produced by the server
+type Error struct {
+	Code       Code
+	Message    string
+	RetryAfter time.Duration // how long to wait before trying again, 0 if retrying will not help
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// builds an *Error with a formatted message
+func Errorf(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// the code for an error: the code of an *Error, invalid_query for an *ArgError,
+// timeout and cancelled for context errors and internal for anything else
+func CodeOf(err error) Code {
+	var apiErr *Error
+	var argErr *ArgError
+	switch {
+	case err == nil:
+		return CodeOK
+	case errors.As(err, &apiErr):
+		return apiErr.Code
+	case errors.As(err, &argErr):
+		return CodeInvalidQuery
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	case errors.Is(err, context.Canceled):
+		return CodeCancelled
+	}
+	return CodeInternal
+}
+
+// the outcome of a request; replies embed it rather than failing the RPC, so
+// results that came with an error (a timeout, say) are not lost
+type Status struct {
+	Code       Code
+	Message    string        // human readable explanation, empty on success
+	RetryAfter time.Duration // set with rate_limited, see Error
+}
+
+// a status describing err, for filling in replies
+func StatusOf(err error) Status {
+	if err == nil {
+		return Status{}
+	}
+	status := Status{Code: CodeOf(err), Message: err.Error()}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		status.RetryAfter = apiErr.RetryAfter
+	}
+	return status
+}
+
+// the status as an error, nil when the code is OK or no match
+func (s Status) Err() error {
+	if s.Code.OK() {
+		return nil
+	}
+	return &Error{Code: s.Code, Message: s.Message, RetryAfter: s.RetryAfter}
+}
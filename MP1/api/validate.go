@@ -0,0 +1,203 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// why an argument of a query was refused
+type ArgError struct {
+	Arg    string // the offending argument as given
+	Reason string
+}
+
+func (e *ArgError) Error() string {
+	return fmt.Sprintf("error: argument %q rejected: %s", e.Arg, e.Reason)
+}
+
+// short flags a query may use, true if they take a value
+var allowedShort = map[byte]bool{
+	'i': false, 'y': false, 'v': false, 'n': false, 'c': false, 'w': false,
+	'E': false, 'F': false, 'G': false,
+	'A': true, 'B': true, 'C': true, 'm': true, 'e': true,
+}
+
+// long flags a query may use, true if they take a value
+var allowedLong = map[string]bool{
+	"ignore-case": false, "invert-match": false, "line-number": false, "count": false,
+	"word-regexp": false, "extended-regexp": false, "fixed-strings": false, "basic-regexp": false,
+	"after-context": true, "before-context": true, "context": true, "max-count": true, "regexp": true,
+	// handled by ParseCommand rather than grep
+	"source": true, "since": true, "until": true, "token": true,
+}
+
+// the most context lines a query may ask for on either side of a match;
+// servers keep up to this many lines in memory per query
+const MaxContext = 1000
+
+// flags that take a number of context lines
+var contextual = map[string]bool{
+	"A": true, "B": true, "C": true,
+	"after-context": true, "before-context": true, "context": true,
+}
+
+// flags that take a number
+var numeric = map[string]bool{
+	"A": true, "B": true, "C": true, "m": true,
+	"after-context": true, "before-context": true, "context": true, "max-count": true,
+}
+
+// grep flags people reach for that are refused on purpose, and why
+var refused = map[string]string{
+	"r":                     "recursive search is not allowed, name a source instead",
+	"R":                     "recursive search is not allowed, name a source instead",
+	"recursive":             "recursive search is not allowed, name a source instead",
+	"dereference-recursive": "recursive search is not allowed, name a source instead",
+	"f":                     "reading patterns from a file is not allowed, use -e",
+	"file":                  "reading patterns from a file is not allowed, use -e",
+	"include":               "file selection is not allowed, name a source instead",
+	"exclude":               "file selection is not allowed, name a source instead",
+	"exclude-from":          "file selection is not allowed, name a source instead",
+	"exclude-dir":           "file selection is not allowed, name a source instead",
+	"d":                     "directory handling is not allowed",
+	"directories":           "directory handling is not allowed",
+	"D":                     "device handling is not allowed",
+	"devices":               "device handling is not allowed",
+}
+
+// checks a tokenized command against the allow-list of flags
+// anything not explicitly allowed is refused with an *ArgError; operands are
+// left alone, file paths are checked by the server against its configured sources
+func Validate(tokens []string) error {
+	if len(tokens) == 0 {
+		return &ArgError{Reason: "empty command"}
+	}
+	if strings.ToLower(tokens[0]) != "grep" {
+		return &ArgError{Arg: tokens[0], Reason: "only grep is supported"}
+	}
+	return readFlags(tokens, func(f cmdFlag) error {
+		return checkValue(f.arg, f.name, f.value)
+	})
+}
+
+// a flag of a command, as grep would read it
+type cmdFlag struct {
+	arg   string // the token it was given in, e.g. -nA3 or --source=app
+	name  string // without dashes
+	value string // empty if it takes none
+	// tokens[at:next] hold the flag and its value; for combined short flags
+	// they hold the whole group
+	at, next int
+}
+
+// calls each for every flag of a command, skipping the command itself, the
+// operands and the values flags take, so that -e --source is a pattern and not
+// a flag; everything after "--" is an operand
+// flags that are not on the allow-list or lack their value are refused with
+// an *ArgError
+func readFlags(tokens []string, each func(cmdFlag) error) error {
+	for i := 1; i < len(tokens); i++ {
+		arg := tokens[i]
+		switch {
+		case arg == "--":
+			// the rest are operands
+			return nil
+
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := strings.Cut(arg[2:], "=")
+			takesValue, ok := allowedLong[name]
+			if !ok {
+				return refusal(arg, name)
+			}
+			if !takesValue && hasValue {
+				return &ArgError{Arg: arg, Reason: "option takes no value"}
+			}
+			at := i
+			if takesValue && !hasValue {
+				if i+1 >= len(tokens) {
+					return &ArgError{Arg: arg, Reason: "option requires a value"}
+				}
+				i++
+				value = tokens[i]
+			}
+			if err := each(cmdFlag{arg: arg, name: name, value: value, at: at, next: i + 1}); err != nil {
+				return err
+			}
+
+		case len(arg) > 1 && arg[0] == '-':
+			// short options may be combined, e.g. -in or -A3
+			var flags []cmdFlag
+			at := i
+			for j := 1; j < len(arg); j++ {
+				takesValue, ok := allowedShort[arg[j]]
+				if !ok {
+					return refusal(arg, string(arg[j]))
+				}
+				f := cmdFlag{arg: arg, name: string(arg[j])}
+				if takesValue {
+					f.value = arg[j+1:]
+					if f.value == "" {
+						if i+1 >= len(tokens) {
+							return &ArgError{Arg: arg, Reason: "option requires a value"}
+						}
+						i++
+						f.value = tokens[i]
+					}
+					j = len(arg)
+				}
+				flags = append(flags, f)
+			}
+			for _, f := range flags {
+				f.at, f.next = at, i+1
+				if err := each(f); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func refusal(arg, name string) error {
+	if reason, ok := refused[name]; ok {
+		return &ArgError{Arg: arg, Reason: reason}
+	}
+	return &ArgError{Arg: arg, Reason: "unsupported option"}
+}
+
+func checkValue(arg, name, value string) error {
+	if !numeric[name] {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return &ArgError{Arg: arg, Reason: fmt.Sprintf("%q is not a non-negative number", value)}
+	}
+	if contextual[name] && n > MaxContext {
+		return &ArgError{Arg: arg, Reason: fmt.Sprintf("at most %d context lines are allowed", MaxContext)}
+	}
+	return nil
+}
+
+// checks a typed request the way Validate checks a command, for requests that
+// did not come from ParseCommand
+func (r GrepRequest) Check() error {
+	limits := []struct {
+		arg     string
+		n       int
+		context bool
+	}{
+		{"-A", r.Options.After, true}, {"-B", r.Options.Before, true},
+		{"-m", r.Options.MaxCount, false}, {"MaxLines", r.MaxLines, false},
+	}
+	for _, limit := range limits {
+		if limit.n < 0 {
+			return &ArgError{Arg: limit.arg, Reason: fmt.Sprintf("%d is not a non-negative number", limit.n)}
+		}
+		if limit.context && limit.n > MaxContext {
+			return &ArgError{Arg: limit.arg, Reason: fmt.Sprintf("at most %d context lines are allowed", MaxContext)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"gb4/grep"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		tokens []string
+		ok     bool
+	}{
+		{[]string{"grep", "foo"}, true},
+		{[]string{"GREP", "foo"}, true},
+		{[]string{"grep", "-inw", "foo", "a.log"}, true},
+		{[]string{"grep", "-A3", "-B", "2", "-C1000", "foo"}, true},
+		{[]string{"grep", "--context=1000", "--max-count", "5", "foo"}, true},
+		{[]string{"grep", "-nm", "0", "foo"}, true},
+		{[]string{"grep", "--source", "app", "--since=1h", "--token", "t", "foo"}, true},
+		{[]string{"grep", "-e", "-r", "-e", "--file"}, true},
+		{[]string{"grep", "--", "-r", "--exclude=x"}, true},
+		{nil, false},
+		{[]string{"egrep", "foo"}, false},
+		{[]string{"grep", "-r", "foo"}, false},
+		{[]string{"grep", "-in", "-R", "foo"}, false},
+		{[]string{"grep", "--recursive", "foo"}, false},
+		{[]string{"grep", "-f", "patterns"}, false},
+		{[]string{"grep", "--include=*.log", "foo"}, false},
+		{[]string{"grep", "-P", "foo"}, false},
+		{[]string{"grep", "--color", "foo"}, false},
+		{[]string{"grep", "--count=yes", "foo"}, false},
+		{[]string{"grep", "-A"}, false},
+		{[]string{"grep", "foo", "--source"}, false},
+		{[]string{"grep", "-A", "x", "foo"}, false},
+		{[]string{"grep", "-m", "-1", "foo"}, false},
+		{[]string{"grep", "-B1001", "foo"}, false},
+		{[]string{"grep", "--after-context", "1001", "foo"}, false},
+		{[]string{"grep", "-nC", "5000", "foo"}, false},
+	}
+	for _, tt := range tests {
+		err := Validate(tt.tokens)
+		if tt.ok && err != nil {
+			t.Errorf("Validate(%q): %v", tt.tokens, err)
+		}
+		if !tt.ok {
+			var argErr *ArgError
+			if !errors.As(err, &argErr) {
+				t.Errorf("Validate(%q) = %v, want an *ArgError", tt.tokens, err)
+			}
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		req  GrepRequest
+		ok   bool
+	}{
+		{"empty", GrepRequest{}, true},
+		{"most context", GrepRequest{Options: grep.Options{Before: MaxContext, After: MaxContext}}, true},
+		{"-m and MaxLines", GrepRequest{Options: grep.Options{MaxCount: 5}, MaxLines: 1 << 20}, true},
+		{"-B over the max", GrepRequest{Options: grep.Options{Before: MaxContext + 1}}, false},
+		{"-A over the max", GrepRequest{Options: grep.Options{After: MaxContext + 1}}, false},
+		{"negative -A", GrepRequest{Options: grep.Options{After: -1}}, false},
+		{"negative -m", GrepRequest{Options: grep.Options{MaxCount: -1}}, false},
+		{"negative MaxLines", GrepRequest{MaxLines: -1}, false},
+	}
+	for _, tt := range tests {
+		err := tt.req.Check()
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok {
+			var argErr *ArgError
+			if !errors.As(err, &argErr) {
+				t.Errorf("%s: Check() = %v, want an *ArgError", tt.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gb4/config"
+)
+
+// a certificate and its key as written to disk
+type pair struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// loads the CA from dir, or creates one if there is none yet so that
+// certificates made by earlier runs stay valid
+func loadOrCreateCA(dir string, validFor time.Duration) (*pair, error) {
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		return parsePair(certPEM, keyPEM)
+	}
+	if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+		return nil, fmt.Errorf("need both %s and %s, or neither", certPath, keyPath)
+	}
+
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "log querier CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	ca, err := issue(template, nil, validFor)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("created CA %s", certPath)
+	return ca, write(dir, "ca", ca)
+}
+
+func parsePair(certPEM, keyPEM []byte) (*pair, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("ca.crt or ca.key is not PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("ca.key cannot sign")
+	}
+	return &pair{cert: cert, key: signer}, nil
+}
+
+// creates a key and a certificate from template, signed by parent or self-signed
+func issue(template *x509.Certificate, parent *pair, validFor time.Duration) (*pair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(validFor)
+
+	signerCert, signerKey := template, crypto.Signer(key)
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, key.Public(), signerKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &pair{cert: cert, key: key}, nil
+}
+
+// writes name.crt and name.key (readable only by the owner) to dir
+func write(dir, name string, p *pair) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(p.key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600)
+}
+
+// a server certificate for a node, valid for the hosts in its address and
+// ssh host; node certificates can also be used as client certificates
+func nodeCert(ca *pair, n config.Node, validFor time.Duration) (*pair, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: fmt.Sprintf("node-%02d", n.ID)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	seen := make(map[string]bool)
+	for _, addr := range []string{n.Address, n.SSHHost} {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return issue(template, ca, validFor)
+}
+
+// a certificate that identifies a client by name
+func clientCert(ca *pair, name string, validFor time.Duration) (*pair, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return issue(template, ca, validFor)
+}
+
+// generates a CA plus a certificate for every node of the cluster and for each
+// client, then prints the cluster file with its "tls" settings filled in
+func main() {
+	clusterPath := flag.String("cluster", config.DefaultClusterPath, "path to the cluster file")
+	out := flag.String("out", "../certs", "directory for the CA and certificates")
+	clients := flag.String("clients", "querier", "comma separated names to make client certificates for")
+	days := flag.Int("days", 365, "how long certificates are valid")
+	flag.Parse()
+
+	cluster, err := config.LoadCluster(*clusterPath)
+	if err != nil {
+		log.Fatalf("error loading cluster: %v", err)
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	validFor := time.Duration(*days) * 24 * time.Hour
+
+	ca, err := loadOrCreateCA(*out, validFor)
+	if err != nil {
+		log.Fatalf("error with CA: %v", err)
+	}
+	files := func(name string) *config.TLS {
+		return &config.TLS{
+			Cert: filepath.Join(*out, name+".crt"),
+			Key:  filepath.Join(*out, name+".key"),
+			CA:   filepath.Join(*out, "ca.crt"),
+		}
+	}
+
+	for i, n := range cluster.Nodes {
+		name := fmt.Sprintf("node-%02d", n.ID)
+		cert, err := nodeCert(ca, n, validFor)
+		if err != nil {
+			log.Fatalf("error making %s: %v", name, err)
+		}
+		if err := write(*out, name, cert); err != nil {
+			log.Fatalf("error writing %s: %v", name, err)
+		}
+		log.Printf("%s: valid for %v %v", name, cert.cert.DNSNames, cert.cert.IPAddresses)
+		cluster.Nodes[i].TLS = files(name)
+	}
+
+	var names []string
+	for _, name := range strings.Split(*clients, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		cert, err := clientCert(ca, name, validFor)
+		if err != nil {
+			log.Fatalf("error making %s: %v", name, err)
+		}
+		if err := write(*out, name, cert); err != nil {
+			log.Fatalf("error writing %s: %v", name, err)
+		}
+		log.Printf("client %s", name)
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		cluster.TLS = files(names[0])
+	}
+
+	// the cluster file with tls filled in, to review and save over the old one
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(cluster)
+}
@@ -9,27 +9,35 @@ import (
 	"os/signal"
     "syscall"
 	"time"
-	"sync"
 	"strconv"
+
+	"gb4/api"
+	"gb4/config"
 )
 
-var totalMatches = 0
+// how long each VM may spend on a query before it gives up, unless told otherwise
+const queryTimeout = 30 * time.Second
 
 // tests valid and invalid grep requests
+// only files of the VM's sources can be searched, the rest should be rejected
 func TestGrep(client *rpc.Client) {
 	cmds := []string{
-		"grep \"package main\" ../server/server.go", 
-		"grep -i \"func\" ../server/server.go",
-		"grep -n \"func main\" ../server/server.go",
-		"grep -A 2 \"import\" ../server/server.go",
-		"grep -E \"error\" ../server/server.go",
-		"grep -E \"&&\" ../server/server.go",
-
-		"grep --noexist \"main\" ../server/server.go",
-		"grep \"main\" noexist.go",         
-		"grep \"main\" ../server/server.go | ls",       
-		"grep \"[badregex\" ../server/server.go",              
-		"gre \"package main\" ../server/server.go",        
+		"grep \"MSIE\" --source log",
+		"grep -i \"mozilla\" --source log",
+		"grep -n \"GET\" --source log",
+		"grep -A 2 \"POST\" --source log",
+		"grep -E \"harper|guzman\" --source log",
+		"grep -c \"MSIE\" --source log",
+
+		"grep --noexist \"main\"",
+		"grep \"main\" noexist.go",
+		"grep \"main\" ../server/server.go",
+		"grep -r \"main\" ..",
+		"grep -f /etc/shadow",
+		"grep --include=*.go \"main\"",
+		"grep \"main\" --source log | ls",
+		"grep \"[badregex\" --source log",
+		"gre \"package main\" --source log",
 	}
 
 	for _,cmd := range cmds {
@@ -43,7 +51,7 @@ func TestGrep(client *rpc.Client) {
 
 // tests functionality on seperate doc
 func TestSpec(client *rpc.Client) {
-	cmd := "grep -n \"main\" ../log/log.txt"
+	cmd := "grep -n \"main\" --source log"
 	var reply string
 	err := client.Call("VM.Grep", cmd, &reply)
 	// -1 placeholder
@@ -51,10 +59,7 @@ func TestSpec(client *rpc.Client) {
 }
 
 func Printer(vm_no int, cmd string, reply string, err error) {
-	fmt.Print("\n------------------------------\n" + 
-	"vm number: " + strconv.Itoa(vm_no) + "\n" +	
-	cmd + 
-	"\n------------------------------\n")
+	PrintHeader(vm_no, cmd)
 
 	if err != nil /* strings.HasPrefix(err.Error(), "error:") */ {
 		fmt.Println(err.Error())
@@ -63,35 +68,21 @@ func Printer(vm_no int, cmd string, reply string, err error) {
 	}
 }
 
-// calls the RPC grep function registered by the server
-// once we set up the VMs we would call the RPC function on every server
-func Call(vm_no int, cmd string, client *rpc.Client) error {
-	err := CheckConnection(client)
-	if err != nil {
-		return err
-	}
-
-	var reply string
-	err = client.Call("VM.Grep", cmd, &reply)
-	Printer(vm_no, cmd, reply, err)
-	
-	var numMatches = 0
-	lines := strings.Split(reply, "\n")
-	if len(lines) > 0 && strings.Contains(lines[len(lines)-1], "MATCHES") {
-    	numMatches, _ = strconv.Atoi(lines[len(lines)-1][9:])
-	}
-	totalMatches += numMatches
-
-
-	return err
+// prints the banner shown above each VM's results
+func PrintHeader(vm_no int, cmd string) {
+	fmt.Print("\n------------------------------\n" + 
+	"vm number: " + strconv.Itoa(vm_no) + "\n" +	
+	cmd + 
+	"\n------------------------------\n")
 }
 
-// calls the RPC confirm connection function registered by the server
-// once we set up the VMs we would validiate there is a valid connection before calling grep
-func CheckConnection(client *rpc.Client) error {
-	client_name := "client" // make this unique per VM
-	var reply string
-	return client.Call("VM.ConfirmConnection", client_name, &reply)
+// asks every VM to stop the query with the given id
+// the calls are fired without waiting so one slow VM does not hold up the rest
+func Cancel(vms map[int]*rpc.Client, queryID string) {
+	for _, vm := range vms {
+		var found bool
+		vm.Go("VM.Cancel", queryID, &found, nil)
+	}
 }
 
 // if is_signal -> closes client due to a signal
@@ -104,60 +95,12 @@ func Kill(is_signal bool) {
 	os.Exit(0)
 }
 
-func Connect() []*rpc.Client {
-	// ip addresses for VMs 01-10
-	ip_adds := []string{
-		// ":4425", // localhost for testing
-		"172.22.159.124:4425",
-		"172.22.155.198:4425",
-		"172.22.155.125:4425",
-		"172.22.159.125:4425",
-		"172.22.155.199:4425",
-		"172.22.155.126:4425",
-		"172.22.159.126:4425",
-		"172.22.155.200:4425",
-		"172.22.155.127:4425",
-		"172.22.159.127:4425",
+// runs the interactive query loop against the nodes of the cluster
+func Client(cluster *config.Cluster, opts Options) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = queryTimeout
 	}
 
-	// create a splice to hold VM connections
-	vms := make([]*rpc.Client, len(ip_adds))
-	var conn = 0
-	var dialNum = 0
-	for conn != 1 {
-		if (dialNum == 2) {
-			fmt.Println("\nFAILED TO CONNECT TO ANY VM!\n")
-			os.Exit(1)
-		} else if dialNum == 1 {
-			fmt.Println("\nATTEMPTING TO CONNECT AGAIN\n")
-			time.Sleep(1 * time.Second)
-		}
-
-		for i, ip := range ip_adds {
-			vm, err := rpc.DialHTTP("tcp", ip)
-			if err != nil {
-				fmt.Printf("error dialing on vm %02d: %v\n", i + 1, err)
-				vms[i] = nil
-				continue
-			}
-			vms[i] = vm
-		}
-
-		for _,vm := range vms {
-			if vm != nil {
-				conn = 1
-				break
-			}
-		}
-
-		time.Sleep(1 * time.Second)
-		dialNum = dialNum + 1
-	}
-
-	return vms
-}
-
-func Client() {
 	// create a channel which asynchronously checks for kill signals
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
@@ -165,10 +108,18 @@ func Client() {
 	// create a buffered io to read from stdin
 	reader := bufio.NewReader(os.Stdin)
 	
-	// sleep to ensure server connection is secure
+	tlsConfig, err := cluster.ClientTLS()
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+
+	// connections stay open across queries and are redialled in the background
+	pool := NewPool(cluster.Nodes, tlsConfig)
+	defer pool.Close()
+	pool.PrintStatus(opts.Token)
 	
 	for {
-		vms := Connect()
 		fmt.Print("\nenter a command: ")
 		
 		// channels for input
@@ -200,35 +151,42 @@ func Client() {
 		case input := <-inputChan:
 			input = strings.TrimSpace(input)
 			if input == "exit" || input == "quit" {
-				// client.Close()
+				pool.Close()
 				Kill(false)
 			}
+			if input == "status" {
+				pool.PrintStatus(opts.Token)
+				continue
+			}
+			// follow grep ... prints new matching lines until ctrl-c
+			command, follow := strings.CutPrefix(input, "follow ")
+
+			req, err := api.ParseCommand(command)
+			if err != nil {
+				fmt.Println(err.Error())
+				continue
+			}
+			// every VM runs the query under the same id so it can be cancelled
+			req.QueryID = api.NewQueryID()
+			req.Timeout = opts.Timeout
+			req.TimeLayouts = opts.layouts()
+			if req.Token == "" {
+				req.Token = opts.Token
+			}
 
-			var totalLatency time.Duration = 0
-			totalMatches = 0
-    		var wg sync.WaitGroup
-
-			for i, vm := range vms {
-				if vm == nil {
-					continue;
-				}
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					start := time.Now()
-					err := Call(i+1, input, vm)
-					if err == nil {
-						t := time.Now()
-						elapsed := t.Sub(start)
-						totalLatency += elapsed
-						fmt.Printf("LATENCY: %s\n", elapsed)
-					}
-				}()
-				wg.Wait()
+			if follow {
+				Follow(pool, req, followed(NewTextOutput(command, req)), signalChan)
+				continue
+			}
+
+			out, err := merged(NewTextOutput(input, req), opts, pool)
+			if err != nil {
+				fmt.Println("error:", err)
+				continue
 			}
-			fmt.Print("\n------------------------------\n" + "RESULTS" + "\n------------------------------\n")
-			fmt.Println("AVERAGE LATENCY:", totalLatency / 10)
-			fmt.Printf("TOTAL MATCHES: %d\n\n", totalMatches)
+
+			// ctrl-c while a query runs cancels it instead of exiting
+			Gather(pool, req, out, signalChan)
 		}
 	}
 }
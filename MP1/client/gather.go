@@ -0,0 +1,251 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"time"
+
+	"gb4/api"
+)
+
+const (
+	// extra time the client waits past the query's own deadline before giving up on a VM
+	deadlineGrace = 2 * time.Second
+	// times a query is sent to a VM that asks to be retried later, see api.Status.RetryAfter
+	maxAttempts = 3
+	// a subscription has no deadline, so each call to a VM gets this long instead
+	followCallTimeout = 10 * time.Second
+)
+
+// outcome of a query on one VM
+type Result struct {
+	VM      int
+	Summary api.GrepReply // totals, counts and errors without lines
+	Err     error
+	Latency time.Duration
+}
+
+// the outcome as a code: the server's code, no_match for a query that found
+// nothing, or unavailable if the VM could not be reached or did not reply
+func (r *Result) Code() api.Code {
+	var apiErr *api.Error
+	switch {
+	case r.Err == nil:
+		return r.Summary.Code
+	case errors.As(r.Err, &apiErr):
+		return apiErr.Code
+	}
+	return api.CodeUnavailable
+}
+
+// receives a query's results as they arrive
+// Gather calls every method from a single goroutine, so outputs need no locking
+type Output interface {
+	// the query is open on a VM and will search these files
+	Open(vm int, files []string)
+	// a batch of lines from a VM
+	Lines(vm int, matches []api.Match)
+	// a VM has finished, successfully or not
+	Done(result *Result)
+	// every VM has finished
+	Finish(results []Result)
+}
+
+// a message from a VM's query goroutine to the coordinator
+type event struct {
+	vm      int
+	files   []string    // set once the query is open
+	matches []api.Match // a batch of lines
+	result  *Result     // set on the last event from the VM
+}
+
+// returned for VMs the pool considers down, they are not queried
+var errDown = errors.New("error: vm is down")
+
+// runs the query on every live VM in the pool at once and hands lines to out
+// as they arrive; a signal on interrupt cancels the query on every VM
+// results are returned in completion order, VMs that are down are reported
+// with errDown without being queried
+//
+// all output and aggregation happens in the calling goroutine, the per-VM
+// goroutines only talk to it through the events channel
+func Gather(pool *Pool, req api.GrepRequest, out Output, interrupt <-chan os.Signal) []Result {
+	return gather(pool, req, out, interrupt, false)
+}
+
+// like Gather, but subscribes to the lines appended to the VMs' logs from now
+// on with VM.Follow and hands them to out until a signal on interrupt; the
+// subscriptions it cancels then end without an error
+func Follow(pool *Pool, req api.GrepRequest, out Output, interrupt <-chan os.Signal) []Result {
+	return gather(pool, req, out, interrupt, true)
+}
+
+func gather(pool *Pool, req api.GrepRequest, out Output, interrupt <-chan os.Signal, follow bool) []Result {
+	vms := pool.Clients()
+	events := make(chan event)
+	pending := 0
+
+	var results []Result
+	for _, id := range pool.IDs() {
+		vm, ok := vms[id]
+		if !ok {
+			result := Result{VM: id, Err: errDown}
+			out.Done(&result)
+			results = append(results, result)
+			continue
+		}
+		pending++
+		go stream(id, req, vm, events, follow)
+	}
+
+	interrupted := false
+	for pending > 0 {
+		select {
+		case <-interrupt:
+			if follow {
+				fmt.Fprintln(os.Stderr, "\nsignal recieved, stopping...")
+			} else {
+				fmt.Fprintln(os.Stderr, "\nsignal recieved, cancelling query...")
+			}
+			interrupted = true
+			Cancel(vms, req.QueryID)
+			// keep draining, the VMs will report the cancellation
+
+		case ev := <-events:
+			switch {
+			case ev.files != nil:
+				out.Open(ev.vm, ev.files)
+
+			case ev.result != nil:
+				if follow && interrupted && ev.result.Code() == api.CodeCancelled {
+					// the way a subscription is meant to end
+					ev.result.Err = nil
+					ev.result.Summary.Status = api.Status{}
+				}
+				pending--
+				pool.Report(ev.vm, ev.result.Err)
+				out.Done(ev.result)
+				results = append(results, *ev.result)
+
+			case len(ev.matches) > 0:
+				out.Lines(ev.vm, ev.matches)
+			}
+		}
+	}
+
+	out.Finish(results)
+	return results
+}
+
+// runs the query on a single VM and reports each step on events
+// gives up if the VM has not finished shortly after the query's deadline, or
+// when following, if it does not answer a call within followCallTimeout
+func stream(vm_no int, req api.GrepRequest, client *rpc.Client, events chan<- event, follow bool) {
+	start := time.Now()
+	result := &Result{VM: vm_no}
+	defer func() {
+		result.Latency = time.Since(start)
+		events <- event{vm: vm_no, result: result}
+	}()
+
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = queryTimeout
+	}
+	method := "VM.Open"
+	deadline := func() time.Time { return start.Add(timeout + deadlineGrace) }
+	if follow {
+		method = "VM.Follow"
+		deadline = func() time.Time { return time.Now().Add(followCallTimeout) }
+	}
+
+	var open api.OpenReply
+	if err := openWithRetry(client, method, deadline(), req, &open); err != nil {
+		result.Err = err
+		return
+	}
+	if err := open.Err(); err != nil {
+		result.Err = err
+		return
+	}
+	events <- event{vm: vm_no, files: open.Files}
+
+	for {
+		var batch api.Batch
+		if err := callBefore(client, deadline(), "VM.Next", api.NextRequest{QueryID: open.QueryID}, &batch); err != nil {
+			result.Err = err
+			return
+		}
+		if len(batch.Matches) > 0 {
+			events <- event{vm: vm_no, matches: batch.Matches}
+		}
+		if batch.Done {
+			// a timeout or cancel ends the query with an error after some lines
+			result.Summary = batch.Summary
+			result.Err = batch.Summary.Err()
+			return
+		}
+	}
+}
+
+// opens the query, waiting and trying again while the VM rate limits it with
+// a retry-after hint that still leaves time before the deadline
+func openWithRetry(client *rpc.Client, method string, deadline time.Time, req api.GrepRequest, open *api.OpenReply) error {
+	for attempt := 1; ; attempt++ {
+		*open = api.OpenReply{}
+		if err := callBefore(client, deadline, method, req, open); err != nil {
+			return err
+		}
+		wait := open.RetryAfter
+		if wait <= 0 || attempt == maxAttempts || time.Now().Add(wait).After(deadline) {
+			return nil
+		}
+		time.Sleep(wait)
+	}
+}
+
+// makes an RPC call that fails if no reply arrives by deadline
+func callBefore(client *rpc.Client, deadline time.Time, method string, args any, reply any) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return fmt.Errorf("error: no reply to %s before the deadline", method)
+	}
+}
+
+// totals across VMs, used for reports and exit codes
+type Totals struct {
+	Matches  int
+	Answered int           // VMs that finished without error
+	Failed   int           // VMs that were down or returned an error
+	Rejected int           // of the failed VMs, those that refused the query as invalid or denied
+	Latency  time.Duration // average over the VMs that answered
+}
+
+func Tally(results []Result) Totals {
+	var t Totals
+	var latency time.Duration
+	for _, result := range results {
+		if result.Err != nil {
+			t.Failed++
+			if code := result.Code(); code == api.CodeInvalidQuery || code == api.CodeDenied {
+				t.Rejected++
+			}
+			continue
+		}
+		t.Answered++
+		t.Matches += result.Summary.Total
+		latency += result.Latency
+	}
+	if t.Answered > 0 {
+		t.Latency = latency / time.Duration(t.Answered)
+	}
+	return t
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"time"
+
+	"gb4/api"
+	"gb4/logtime"
+)
+
+// puts the lines from every VM into one chronologically ordered stream before
+// handing them to another output
+//
+// each VM's lines are assumed to already be in time order (logs are appended),
+// so this is a k-way merge: a line is only passed on once every VM that is still
+// running has a line waiting, or has finished, so nothing earlier can turn up
+// lines without a timestamp, like stack traces, keep the time of the line before
+// them on the same VM so they stay attached to it
+type MergeOutput struct {
+	out    Output
+	parser *logtime.Parser
+	queues map[int]*mergeQueue
+}
+
+// lines from one VM waiting to be merged
+type mergeQueue struct {
+	lines  []stamped
+	last   time.Time // time of the last line seen with a timestamp
+	done   bool
+	result *Result // passed on once the VM is done and its lines are
+}
+
+type stamped struct {
+	at    time.Time
+	match api.Match
+}
+
+// merges the lines from the given VMs in front of out; every one of them must
+// eventually be reported through Done, which Gather does even for VMs that are down
+// text output switches to tagging each line with its VM, banners would be useless
+func NewMergeOutput(out Output, parser *logtime.Parser, vms []int) *MergeOutput {
+	if text, ok := out.(*TextOutput); ok {
+		text.Tagged = true
+	}
+	m := &MergeOutput{out: out, parser: parser, queues: make(map[int]*mergeQueue)}
+	for _, vm := range vms {
+		m.queues[vm] = &mergeQueue{}
+	}
+	return m
+}
+
+// wraps out in a MergeOutput for the pool's VMs if opts ask for merged output
+func merged(out Output, opts Options, pool *Pool) (Output, error) {
+	if !opts.Merge {
+		return out, nil
+	}
+	parser, err := logtime.ParseList(opts.TimeLayouts)
+	if err != nil {
+		return nil, err
+	}
+	return NewMergeOutput(out, parser, pool.IDs()), nil
+}
+
+func (m *MergeOutput) Open(vm int, files []string) {
+	m.out.Open(vm, files)
+}
+
+func (m *MergeOutput) Lines(vm int, matches []api.Match) {
+	q := m.queue(vm)
+	for _, match := range matches {
+		if at, ok := m.parser.Parse(match.Text); ok {
+			q.last = at
+		}
+		q.lines = append(q.lines, stamped{at: q.last, match: match})
+	}
+	m.drain(false)
+}
+
+// the VM's result follows its last line, which may have to wait for the
+// other VMs
+func (m *MergeOutput) Done(result *Result) {
+	q := m.queue(result.VM)
+	q.done, q.result = true, result
+	m.finish(q)
+	m.drain(false)
+}
+
+func (m *MergeOutput) Finish(results []Result) {
+	m.drain(true)
+	m.out.Finish(results)
+}
+
+func (m *MergeOutput) queue(vm int) *mergeQueue {
+	q, ok := m.queues[vm]
+	if !ok {
+		q = &mergeQueue{}
+		m.queues[vm] = q
+	}
+	return q
+}
+
+// passes on the earliest waiting line for as long as it is safe to, or until
+// every queue is empty if all is set
+func (m *MergeOutput) drain(all bool) {
+	for {
+		next := -1
+		for vm, q := range m.queues {
+			if len(q.lines) == 0 {
+				if !q.done && !all {
+					// this VM may still send something earlier
+					return
+				}
+				continue
+			}
+			// ties go to the lower VM number so the order is stable
+			if next == -1 || q.lines[0].at.Before(m.queues[next].lines[0].at) ||
+				(q.lines[0].at.Equal(m.queues[next].lines[0].at) && vm < next) {
+				next = vm
+			}
+		}
+		if next == -1 {
+			return
+		}
+
+		q := m.queues[next]
+		line := q.lines[0]
+		q.lines = q.lines[1:]
+		m.out.Lines(next, []api.Match{line.match})
+		m.finish(q)
+	}
+}
+
+// passes on a VM's result once it is done and its last line has been passed on
+func (m *MergeOutput) finish(q *mergeQueue) {
+	if q.done && len(q.lines) == 0 && q.result != nil {
+		m.out.Done(q.result)
+		q.result = nil
+	}
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"gb4/api"
+	"gb4/logtime"
+)
+
+// notes what a MergeOutput passes on, e.g. "1 line a" or "2 done"
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) Open(vm int, files []string) {}
+
+func (r *recorder) Lines(vm int, matches []api.Match) {
+	for _, m := range matches {
+		r.events = append(r.events, fmt.Sprintf("%d %s", vm, m.Text))
+	}
+}
+
+func (r *recorder) Done(result *Result) {
+	r.events = append(r.events, fmt.Sprintf("%d done", result.VM))
+}
+
+func (r *recorder) Finish(results []Result) {
+	r.events = append(r.events, "finish")
+}
+
+// a log line at second sec
+func at(sec int) api.Match {
+	return api.Match{Text: fmt.Sprintf("2024-01-02T03:04:%02dZ line %d", sec, sec)}
+}
+
+func TestMergeOutput(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps func(m *MergeOutput)
+		want  []string
+	}{
+		{
+			name: "in time order",
+			steps: func(m *MergeOutput) {
+				m.Lines(1, []api.Match{at(1), at(3)})
+				m.Lines(2, []api.Match{at(2)})
+				m.Done(&Result{VM: 1})
+				// vm 1's last line waits for vm 2, its result with it
+				m.Done(&Result{VM: 2})
+			},
+			want: []string{"1 " + at(1).Text, "2 " + at(2).Text, "2 done", "1 " + at(3).Text, "1 done", "finish"},
+		},
+		{
+			name: "done waits for the vm's queued lines",
+			steps: func(m *MergeOutput) {
+				m.Lines(1, []api.Match{at(1), at(3)})
+				m.Done(&Result{VM: 1})
+				m.Lines(2, []api.Match{at(2)})
+				m.Done(&Result{VM: 2})
+			},
+			want: []string{"1 " + at(1).Text, "2 " + at(2).Text, "2 done", "1 " + at(3).Text, "1 done", "finish"},
+		},
+		{
+			name: "done with nothing queued",
+			steps: func(m *MergeOutput) {
+				m.Done(&Result{VM: 2})
+				m.Lines(1, []api.Match{at(1)})
+				m.Done(&Result{VM: 1})
+			},
+			want: []string{"2 done", "1 " + at(1).Text, "1 done", "finish"},
+		},
+		{
+			name: "untimed lines stay with the line before them",
+			steps: func(m *MergeOutput) {
+				m.Lines(1, []api.Match{at(1), {Text: "trace"}, at(4)})
+				m.Lines(2, []api.Match{at(2)})
+				m.Done(&Result{VM: 2})
+				m.Done(&Result{VM: 1})
+			},
+			want: []string{"1 " + at(1).Text, "1 trace", "2 " + at(2).Text, "2 done", "1 " + at(4).Text, "1 done", "finish"},
+		},
+	}
+	for _, tt := range tests {
+		parser, err := logtime.ParseList("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out recorder
+		m := NewMergeOutput(&out, parser, []int{1, 2})
+		tt.steps(m)
+		m.Finish(nil)
+		if !reflect.DeepEqual(out.events, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, out.events, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"gb4/api"
+	"gb4/config"
+)
+
+// exit codes of a one-shot query
+const (
+	ExitMatches = 0 // every node answered and something matched
+	ExitNoMatch = 1 // every node answered and nothing matched
+	ExitPartial = 2 // some nodes failed, the results are incomplete
+	ExitFailed  = 3 // no node answered
+	ExitUsage   = 4 // bad flags or an invalid query
+)
+
+// settings for a one-shot query, the interactive client uses Timeout and the merge settings
+type Options struct {
+	Expr    string        // the grep command, e.g. grep -i error
+	Format  string        // one of Formats
+	Timeout time.Duration // per-query deadline on each node
+	Nodes   string        // node spec such as 1-4, empty for all nodes
+
+	Token string // presented to servers with an access policy
+
+	Merge       bool   // order lines from all nodes by their timestamps
+	TimeLayouts string // comma separated timestamp layouts for Merge and --since/--until, empty for logtime.Default
+
+	Follow bool // print new matching lines from every node until ctrl-c instead of searching once
+}
+
+// the timestamp layouts as sent to the servers
+func (o Options) layouts() []string {
+	if o.TimeLayouts == "" {
+		return nil
+	}
+	return strings.Split(o.TimeLayouts, ",")
+}
+
+// runs a single query against the selected nodes, prints the results and
+// returns the exit code for the process
+func RunOnce(cluster *config.Cluster, opts Options) int {
+	nodes, err := cluster.Select(opts.Nodes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return ExitUsage
+	}
+	tlsConfig, err := cluster.ClientTLS()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return ExitUsage
+	}
+
+	req, err := api.ParseCommand(opts.Expr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	req.QueryID = api.NewQueryID()
+	req.Timeout = opts.Timeout
+	req.TimeLayouts = opts.layouts()
+	if req.Token == "" {
+		req.Token = opts.Token
+	}
+
+	out, err := NewOutput(opts.Format, os.Stdout, opts.Expr, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return ExitUsage
+	}
+
+	pool := NewPool(nodes, tlsConfig)
+	defer pool.Close()
+
+	// ctrl-c cancels the query on every node, whatever finished is still printed
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalChan)
+
+	if opts.Follow {
+		if opts.Merge {
+			fmt.Fprintln(os.Stderr, "error: -merge cannot be used with -follow, live lines are printed as they arrive")
+			return ExitUsage
+		}
+		return ExitCode(Tally(Follow(pool, req, followed(out), signalChan)))
+	}
+
+	if out, err = merged(out, opts, pool); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return ExitUsage
+	}
+	return ExitCode(Tally(Gather(pool, req, out, signalChan)))
+}
+
+// lines from every node arrive interleaved while following, so text output
+// tags each line with its node instead of printing banners
+func followed(out Output) Output {
+	if text, ok := out.(*TextOutput); ok {
+		text.Tagged = true
+	}
+	return out
+}
+
+// maps query totals to a process exit code
+// a query every node refused as invalid or denied is a usage error, like a
+// query the client refuses itself
+func ExitCode(totals Totals) int {
+	switch {
+	case totals.Answered == 0 && totals.Failed > 0 && totals.Rejected == totals.Failed:
+		return ExitUsage
+	case totals.Answered == 0:
+		return ExitFailed
+	case totals.Failed > 0:
+		return ExitPartial
+	case totals.Matches == 0:
+		return ExitNoMatch
+	default:
+		return ExitMatches
+	}
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"gb4/api"
+)
+
+func TestExitCode(t *testing.T) {
+	matched := Result{Summary: api.GrepReply{Total: 3}}
+	empty := Result{Summary: api.GrepReply{Status: api.Status{Code: api.CodeNoMatch}}}
+	down := Result{Err: errDown}
+	invalid := Result{Err: api.Errorf(api.CodeInvalidQuery, "error: bad pattern")}
+	denied := Result{Err: api.Errorf(api.CodeDenied, "error: access denied")}
+	timedOut := Result{Err: api.Errorf(api.CodeTimeout, "error: timed out")}
+	broken := Result{Err: errors.New("connection reset")}
+
+	tests := []struct {
+		name    string
+		results []Result
+		want    int
+	}{
+		{"matches", []Result{matched, empty}, ExitMatches},
+		{"no match", []Result{empty, empty}, ExitNoMatch},
+		{"partial", []Result{matched, down}, ExitPartial},
+		{"partial with a refusal", []Result{empty, invalid}, ExitPartial},
+		{"all down", []Result{down, broken}, ExitFailed},
+		{"all timed out", []Result{timedOut, timedOut}, ExitFailed},
+		{"all invalid", []Result{invalid, invalid}, ExitUsage},
+		{"all denied", []Result{denied}, ExitUsage},
+		{"invalid or denied", []Result{invalid, denied}, ExitUsage},
+		{"refused and down", []Result{invalid, down}, ExitFailed},
+		{"no nodes", nil, ExitFailed},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(Tally(tt.results)); got != tt.want {
+			t.Errorf("%s: exit %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
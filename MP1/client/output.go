@@ -0,0 +1,357 @@
+package client
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gb4/api"
+)
+
+// prints grep style output with a banner per VM, as the interactive client always has
+// when Tagged is set lines are prefixed with their VM instead, for merged output
+// where lines from different VMs are interleaved
+type TextOutput struct {
+	Tagged bool
+
+	cmd        string
+	req        api.GrepRequest
+	formatters map[int]*api.Formatter
+	current    int
+}
+
+func NewTextOutput(cmd string, req api.GrepRequest) *TextOutput {
+	return &TextOutput{cmd: cmd, req: req, formatters: make(map[int]*api.Formatter)}
+}
+
+// banner whenever the output switches to another VM
+func (t *TextOutput) header(vm int) {
+	if vm != t.current {
+		PrintHeader(vm, t.cmd)
+		t.current = vm
+	}
+}
+
+func (t *TextOutput) Open(vm int, files []string) {
+	t.formatters[vm] = &api.Formatter{Options: t.req.Options, Multi: len(files) > 1}
+}
+
+func (t *TextOutput) Lines(vm int, matches []api.Match) {
+	if t.Tagged {
+		fmt.Print(tag(vm, t.formatters[vm].Format(matches)))
+		return
+	}
+	t.header(vm)
+	fmt.Print(t.formatters[vm].Format(matches))
+}
+
+// prefixes every line of text with the VM it came from
+func tag(vm int, text string) string {
+	if text == "" {
+		return ""
+	}
+	prefix := fmt.Sprintf("vm %02d: ", vm)
+	lines := strings.SplitAfter(strings.TrimSuffix(text, "\n"), "\n")
+	return prefix + strings.Join(lines, prefix) + "\n"
+}
+
+// prints the end of a VM's output: counts, errors and its own totals
+// VMs that are down only show up in the final results
+func (t *TextOutput) Done(result *Result) {
+	if result.Err == errDown {
+		return
+	}
+	if t.Tagged {
+		t.doneTagged(result)
+		return
+	}
+	t.header(result.VM)
+
+	if result.Err != nil {
+		fmt.Println(result.Err.Error())
+		return
+	}
+
+	summary := result.Summary
+	if counts := summary.CountText(); t.req.Options.Count && counts != "" {
+		fmt.Println(counts)
+	}
+	for _, failure := range summary.Errors {
+		fmt.Println(failure)
+	}
+	if summary.Truncated {
+		fmt.Println("(output truncated)")
+	}
+	fmt.Printf("MATCHES: %d\n", summary.Total)
+	fmt.Printf("LATENCY: %s\n", result.Latency)
+}
+
+// in tagged mode only what cannot wait for the results table is printed
+func (t *TextOutput) doneTagged(result *Result) {
+	if result.Err != nil {
+		fmt.Print(tag(result.VM, result.Err.Error()))
+		return
+	}
+	if counts := result.Summary.CountText(); t.req.Options.Count && counts != "" {
+		fmt.Print(tag(result.VM, counts))
+	}
+	for _, failure := range result.Summary.Errors {
+		fmt.Print(tag(result.VM, failure))
+	}
+	if result.Summary.Truncated {
+		fmt.Print(tag(result.VM, "(output truncated)"))
+	}
+}
+
+// prints totals across VMs; the average latency only counts VMs that answered
+func (t *TextOutput) Finish(results []Result) {
+	fmt.Print("\n------------------------------\n" + "RESULTS" + "\n------------------------------\n")
+
+	for _, result := range byVM(results) {
+		if result.Err != nil {
+			fmt.Printf("vm %02d: %v\n", result.VM, result.Err)
+			continue
+		}
+		fmt.Printf("vm %02d: %d matches in %s\n", result.VM, result.Summary.Total, result.Latency)
+	}
+
+	totals := Tally(results)
+	fmt.Printf("VMS ANSWERED: %d/%d\n", totals.Answered, len(results))
+	if totals.Answered > 0 {
+		fmt.Println("AVERAGE LATENCY:", totals.Latency)
+	}
+	fmt.Printf("TOTAL MATCHES: %d\n\n", totals.Matches)
+}
+
+// a line of output tagged with the node it came from
+type Record struct {
+	Type    string `json:"type,omitempty"` // "match" in NDJSON output
+	Node    int    `json:"node"`
+	Source  string `json:"source,omitempty"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Offset  int64  `json:"offset"`
+	Text    string `json:"text"`
+	Context bool   `json:"context,omitempty"`
+}
+
+func newRecord(vm int, m api.Match) Record {
+	return Record{
+		Node:    vm,
+		Source:  m.Source,
+		File:    m.File,
+		Line:    m.Line,
+		Offset:  m.Offset,
+		Text:    m.Text,
+		Context: m.Context,
+	}
+}
+
+// how one node did
+type NodeSummary struct {
+	Node      int            `json:"node"`
+	Hostname  string         `json:"hostname,omitempty"`
+	Matches   int            `json:"matches"`
+	Counts    map[string]int `json:"counts,omitempty"` // matches per file
+	Errors    []string       `json:"errors,omitempty"` // files that could not be searched
+	Truncated bool           `json:"truncated,omitempty"`
+	LatencyMS float64        `json:"latency_ms"`
+	Code      api.Code       `json:"code,omitempty"`  // see api.Code, empty if something matched
+	Error     string         `json:"error,omitempty"` // set if the node failed
+}
+
+// per-node counts, errors and latencies plus totals for a query
+type Summary struct {
+	Type         string        `json:"type,omitempty"` // "summary" in NDJSON output
+	Query        string        `json:"query"`
+	Nodes        []NodeSummary `json:"nodes"`
+	Total        int           `json:"total"`
+	Answered     int           `json:"answered"`
+	Failed       int           `json:"failed"`
+	AvgLatencyMS float64       `json:"avg_latency_ms"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func newSummary(cmd string, results []Result) Summary {
+	s := Summary{Query: cmd, Nodes: []NodeSummary{}}
+	for _, result := range byVM(results) {
+		node := NodeSummary{
+			Node:      result.VM,
+			Hostname:  result.Summary.Hostname,
+			Matches:   result.Summary.Total,
+			Counts:    result.Summary.Counts,
+			Errors:    result.Summary.Errors,
+			Truncated: result.Summary.Truncated,
+			LatencyMS: milliseconds(result.Latency),
+			Code:      result.Code(),
+		}
+		if result.Err != nil {
+			node.Error = result.Err.Error()
+		}
+		s.Nodes = append(s.Nodes, node)
+	}
+
+	totals := Tally(results)
+	s.Total = totals.Matches
+	s.Answered = totals.Answered
+	s.Failed = totals.Failed
+	s.AvgLatencyMS = milliseconds(totals.Latency)
+	return s
+}
+
+// the formats accepted by --format
+var Formats = []string{"text", "json", "ndjson", "csv", "summary"}
+
+// builds the output for a format name
+func NewOutput(format string, w io.Writer, cmd string, req api.GrepRequest) (Output, error) {
+	switch format {
+	case "", "text":
+		return NewTextOutput(cmd, req), nil
+	case "json":
+		return NewJSONOutput(w, cmd), nil
+	case "ndjson":
+		return NewNDJSONOutput(w, cmd), nil
+	case "csv":
+		return NewCSVOutput(w), nil
+	case "summary":
+		return NewSummaryOutput(w, cmd), nil
+	}
+	return nil, fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(Formats, ", "))
+}
+
+// the whole result of a query as a single JSON document
+type Report struct {
+	Query   string   `json:"query"`
+	Matches []Record `json:"matches"`
+	Summary Summary  `json:"summary"`
+}
+
+// collects everything and writes one JSON document once all VMs are done
+type JSONOutput struct {
+	w      io.Writer
+	report Report
+}
+
+func NewJSONOutput(w io.Writer, cmd string) *JSONOutput {
+	return &JSONOutput{w: w, report: Report{Query: cmd, Matches: []Record{}}}
+}
+
+func (j *JSONOutput) Open(vm int, files []string) {}
+
+func (j *JSONOutput) Lines(vm int, matches []api.Match) {
+	for _, m := range matches {
+		j.report.Matches = append(j.report.Matches, newRecord(vm, m))
+	}
+}
+
+func (j *JSONOutput) Done(result *Result) {}
+
+func (j *JSONOutput) Finish(results []Result) {
+	j.report.Summary = newSummary(j.report.Query, results)
+
+	enc := json.NewEncoder(j.w)
+	enc.SetIndent("", "  ")
+	enc.Encode(j.report)
+}
+
+// writes one JSON object per line as matches arrive, then a summary line
+// lines have "type": "match" or "type": "summary", e.g. for jq 'select(.type == "match")'
+type NDJSONOutput struct {
+	enc *json.Encoder
+	cmd string
+}
+
+func NewNDJSONOutput(w io.Writer, cmd string) *NDJSONOutput {
+	return &NDJSONOutput{enc: json.NewEncoder(w), cmd: cmd}
+}
+
+func (n *NDJSONOutput) Open(vm int, files []string) {}
+
+func (n *NDJSONOutput) Lines(vm int, matches []api.Match) {
+	for _, m := range matches {
+		record := newRecord(vm, m)
+		record.Type = "match"
+		n.enc.Encode(record)
+	}
+}
+
+func (n *NDJSONOutput) Done(result *Result) {}
+
+func (n *NDJSONOutput) Finish(results []Result) {
+	summary := newSummary(n.cmd, results)
+	summary.Type = "summary"
+	n.enc.Encode(summary)
+}
+
+// writes a CSV row per match as matches arrive, with a header row first
+type CSVOutput struct {
+	w *csv.Writer
+}
+
+var csvHeader = []string{"node", "source", "file", "line", "offset", "context", "text"}
+
+func NewCSVOutput(w io.Writer) *CSVOutput {
+	c := &CSVOutput{w: csv.NewWriter(w)}
+	c.w.Write(csvHeader)
+	return c
+}
+
+func (c *CSVOutput) Open(vm int, files []string) {}
+
+func (c *CSVOutput) Lines(vm int, matches []api.Match) {
+	for _, m := range matches {
+		c.w.Write([]string{
+			strconv.Itoa(vm),
+			m.Source,
+			m.File,
+			strconv.Itoa(m.Line),
+			strconv.FormatInt(m.Offset, 10),
+			strconv.FormatBool(m.Context),
+			m.Text,
+		})
+	}
+	c.w.Flush()
+}
+
+func (c *CSVOutput) Done(result *Result) {}
+
+func (c *CSVOutput) Finish(results []Result) {
+	c.w.Flush()
+}
+
+// writes only the summary object, for per-node counts without the lines
+type SummaryOutput struct {
+	w   io.Writer
+	cmd string
+}
+
+func NewSummaryOutput(w io.Writer, cmd string) *SummaryOutput {
+	return &SummaryOutput{w: w, cmd: cmd}
+}
+
+func (s *SummaryOutput) Open(vm int, files []string) {}
+
+func (s *SummaryOutput) Lines(vm int, matches []api.Match) {}
+
+func (s *SummaryOutput) Done(result *Result) {}
+
+func (s *SummaryOutput) Finish(results []Result) {
+	enc := json.NewEncoder(s.w)
+	enc.SetIndent("", "  ")
+	enc.Encode(newSummary(s.cmd, results))
+}
+
+// returns a copy of results sorted by VM number
+func byVM(results []Result) []Result {
+	sorted := append([]Result(nil), results...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].VM < sorted[j].VM })
+	return sorted
+}
@@ -0,0 +1,293 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+
+	"gb4/config"
+)
+
+const (
+	// how often every connection is probed
+	probeInterval = 2 * time.Second
+	// a probe or dial slower than this counts as a failure
+	probeTimeout = 2 * time.Second
+	// failed probes in a row before a suspect VM is marked down
+	maxFailures = 3
+	// redial delays double from minBackoff up to maxBackoff
+	minBackoff = 1 * time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// health of a VM as seen by the pool
+type State int
+
+const (
+	Down    State = iota // no connection, waiting to redial
+	Suspect              // connected but the last probe failed
+	Up                   // connected and answering probes
+)
+
+func (s State) String() string {
+	switch s {
+	case Up:
+		return "up"
+	case Suspect:
+		return "suspect"
+	default:
+		return "down"
+	}
+}
+
+// one VM's connection and health
+type node struct {
+	vm   int
+	addr string
+	tls  *tls.Config // nil for plain connections
+
+	mu       sync.Mutex
+	client   *rpc.Client
+	state    State
+	failures int
+	backoff  time.Duration
+	nextDial time.Time
+}
+
+// long-lived connections to every VM, kept healthy in the background
+// the query path only reads the current state and never waits on the network
+type Pool struct {
+	nodes []*node
+	stop  chan struct{}
+}
+
+// dials every node once and starts probing in the background
+// with a tls config every connection uses TLS, see config.TLS.ClientConfig
+// VMs that cannot be reached are redialled with exponential backoff
+func NewPool(nodes []config.Node, tlsConfig *tls.Config) *Pool {
+	p := &Pool{stop: make(chan struct{})}
+	for _, n := range nodes {
+		p.nodes = append(p.nodes, &node{vm: n.ID, addr: n.Address, tls: tlsConfig, backoff: minBackoff})
+	}
+
+	p.check()
+	go p.loop()
+	return p
+}
+
+// returns the connections of the VMs that are not down, keyed by node id
+func (p *Pool) Clients() map[int]*rpc.Client {
+	clients := make(map[int]*rpc.Client, len(p.nodes))
+	for _, n := range p.nodes {
+		n.mu.Lock()
+		if n.state != Down && n.client != nil {
+			clients[n.vm] = n.client
+		}
+		n.mu.Unlock()
+	}
+	return clients
+}
+
+// returns the node ids in the pool, in cluster file order
+func (p *Pool) IDs() []int {
+	ids := make([]int, len(p.nodes))
+	for i, n := range p.nodes {
+		ids[i] = n.vm
+	}
+	return ids
+}
+
+// returns the state of every VM, keyed by node id
+func (p *Pool) States() map[int]State {
+	states := make(map[int]State, len(p.nodes))
+	for _, n := range p.nodes {
+		n.mu.Lock()
+		states[n.vm] = n.state
+		n.mu.Unlock()
+	}
+	return states
+}
+
+// called by the query path when a call fails, so a broken connection is
+// dropped straight away instead of at the next probe
+func (p *Pool) Report(vm int, err error) {
+	if !isConnError(err) {
+		return
+	}
+	for _, n := range p.nodes {
+		if n.vm == vm {
+			n.fail(err)
+		}
+	}
+}
+
+// stops probing and closes every connection
+func (p *Pool) Close() {
+	close(p.stop)
+	for _, n := range p.nodes {
+		n.mu.Lock()
+		if n.client != nil {
+			n.client.Close()
+			n.client = nil
+		}
+		n.state = Down
+		n.mu.Unlock()
+	}
+}
+
+func (p *Pool) loop() {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+// probes connected VMs and redials the ones whose backoff has expired
+func (p *Pool) check() {
+	var wg sync.WaitGroup
+	for _, n := range p.nodes {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			n.check()
+		}(n)
+	}
+	wg.Wait()
+}
+
+func (n *node) check() {
+	n.mu.Lock()
+	client := n.client
+	due := time.Now().After(n.nextDial)
+	n.mu.Unlock()
+
+	if client == nil {
+		if due {
+			n.dial()
+		}
+		return
+	}
+
+	if err := probe(client); err != nil {
+		n.fail(err)
+		return
+	}
+
+	n.mu.Lock()
+	n.state = Up
+	n.failures = 0
+	n.mu.Unlock()
+}
+
+func (n *node) dial() {
+	client, err := Dial(n.addr, n.tls, probeTimeout)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		n.nextDial = time.Now().Add(n.backoff)
+		n.backoff = min(n.backoff*2, maxBackoff)
+		return
+	}
+
+	if n.state == Down && !n.nextDial.IsZero() {
+		fmt.Fprintf(os.Stderr, "\nvm %02d is back up\n", n.vm)
+	}
+	n.client = client
+	n.state = Up
+	n.failures = 0
+	n.backoff = minBackoff
+}
+
+// records a failed probe or call; a dead connection is dropped at once,
+// otherwise the VM is suspect until maxFailures probes in a row fail
+func (n *node) fail(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.client == nil {
+		return
+	}
+
+	n.failures++
+	if isConnError(err) || n.failures >= maxFailures {
+		fmt.Fprintf(os.Stderr, "\nvm %02d is down: %v\n", n.vm, err)
+		n.client.Close()
+		n.client = nil
+		n.state = Down
+		n.nextDial = time.Now().Add(n.backoff)
+		return
+	}
+	n.state = Suspect
+}
+
+// a probe that gives up after probeTimeout
+func probe(client *rpc.Client) error {
+	var reply string
+	call := client.Go("VM.ConfirmConnection", "client", &reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(probeTimeout):
+		return errors.New("probe timed out")
+	}
+}
+
+// reports whether err means the connection itself is gone
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// same as rpc.DialHTTP but gives up after timeout, and speaks TLS if
+// tlsConfig is set; the server's certificate must be valid for addr's host
+func Dial(addr string, tlsConfig *tls.Config, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if tlsConfig != nil {
+		cfg := tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		secure := tls.Client(conn, cfg)
+		if err := secure.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = secure
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.Status != "200 Connected to Go RPC" {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return rpc.NewClient(conn), nil
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+
+	"gb4/api"
+	"gb4/config"
+)
+
+// asks every connected VM for its VM.Status in parallel, VMs that do not
+// answer within probeTimeout are left out; servers with an access policy only
+// describe the sources token may search
+func (p *Pool) Statuses(token string) map[int]*api.ServerStatus {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	statuses := make(map[int]*api.ServerStatus)
+
+	for vm, client := range p.Clients() {
+		wg.Add(1)
+		go func(vm int, client *rpc.Client) {
+			defer wg.Done()
+			status := new(api.ServerStatus)
+			call := client.Go("VM.Status", token, status, make(chan *rpc.Call, 1))
+			select {
+			case <-call.Done:
+				if call.Error != nil {
+					p.Report(vm, call.Error)
+					return
+				}
+			case <-time.After(probeTimeout):
+				return
+			}
+			mu.Lock()
+			statuses[vm] = status
+			mu.Unlock()
+		}(vm, client)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// prints a table with a row per VM: its connection state and, for the ones
+// that answered, version, uptime, load and sources, followed by anything
+// that keeps a VM from being ready
+func (p *Pool) PrintStatus(token string) {
+	p.WriteStatus(os.Stdout, token)
+}
+
+// like PrintStatus, but to w; returns the number of VMs that are down or not ready
+func (p *Pool) WriteStatus(w io.Writer, token string) int {
+	states := p.States()
+	statuses := p.Statuses(token)
+
+	fmt.Fprintf(w, "%-5s  %-22s %-8s %-16s %-12s %9s %8s %-14s %-8s %s\n",
+		"vm", "address", "state", "host", "version", "uptime", "run/wait", "load", "sources", "size")
+	var problems []string
+	bad := 0
+	for _, n := range p.nodes {
+		status := statuses[n.vm]
+		if status == nil {
+			fmt.Fprintf(w, "vm %02d  %-22s %s\n", n.vm, n.addr, states[n.vm])
+			bad++
+			continue
+		}
+
+		readable, size := 0, int64(0)
+		for _, src := range status.Sources {
+			if src.Readable {
+				readable++
+			}
+			for _, f := range src.Files {
+				size += f.Size
+			}
+		}
+		fmt.Fprintf(w, "vm %02d  %-22s %-8s %-16s %-12s %9s %8s %-14s %-8s %s\n",
+			n.vm, n.addr, states[n.vm], status.Hostname, status.Version, status.Uptime,
+			fmt.Sprintf("%d/%d", status.Running, status.Queued),
+			fmt.Sprintf("%.2f %.2f %.2f", status.LoadAvg[0], status.LoadAvg[1], status.LoadAvg[2]),
+			fmt.Sprintf("%d/%d", readable, len(status.Sources)), formatSize(size))
+
+		if !status.Ready {
+			bad++
+			for _, problem := range status.Problems {
+				problems = append(problems, fmt.Sprintf("vm %02d: %s", n.vm, problem))
+			}
+		}
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem)
+	}
+	return bad
+}
+
+// prints the status table for the given nodes once and returns 0 if every
+// one of them is up and ready, 1 otherwise
+func PrintClusterStatus(cluster *config.Cluster, nodes []config.Node, token string) int {
+	tlsConfig, err := cluster.ClientTLS()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return ExitUsage
+	}
+	pool := NewPool(nodes, tlsConfig)
+	defer pool.Close()
+
+	if pool.WriteStatus(os.Stdout, token) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// a byte count in the largest unit that keeps it above 1, e.g. 12.3MB
+func formatSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	size, unit := float64(n)/1024, 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%cB", size, units[unit])
+}
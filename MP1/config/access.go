@@ -0,0 +1,139 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// flags a grant can allow; -C allows both -A and -B
+var GrantFlags = []string{"-i", "-v", "-n", "-c", "-w", "-E", "-F", "-A", "-B", "-C", "-m"}
+
+// what the holder of a token may query
+type Grant struct {
+	Name        string   `json:"name"`         // who the token belongs to, shown in the audit log
+	TokenSHA256 string   `json:"token_sha256"` // hex SHA-256 of the token, the token itself is never stored
+	Sources     []string `json:"sources"`      // sources the holder may search, "*" for all
+	Flags       []string `json:"flags"`        // grep flags the holder may use, empty for all
+	Rate        *Rate    `json:"rate"`         // overrides the server's rate for the holder
+}
+
+// who may query which sources with which flags
+// a server without an access policy answers every query
+type Access struct {
+	Grants []Grant `json:"grants"`
+	// what callers without a token may do, nil turns them away
+	Anonymous *Grant `json:"anonymous"`
+}
+
+// reads an access policy from a JSON file, e.g.
+//
+//	{
+//	  "grants": [
+//	    {"name": "ops", "token_sha256": "5e88...", "sources": ["*"]},
+//	    {"name": "contractor", "token_sha256": "9f86...", "sources": ["app"], "flags": ["-i", "-n", "-c"],
+//	     "rate": {"per_second": 0.5, "burst": 5}}
+//	  ]
+//	}
+//
+// the hash of a token is printed by: printf %s "$TOKEN" | sha256sum
+func LoadAccess(path string) (*Access, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var a Access
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, fmt.Errorf("access %s: %v", path, err)
+	}
+	if err := a.Validate(); err != nil {
+		return nil, fmt.Errorf("access %s: %v", path, err)
+	}
+	return &a, nil
+}
+
+// checks that grants are named, have a well-formed hash, at least one source
+// and only known flags
+func (a *Access) Validate() error {
+	names := make(map[string]bool)
+	check := func(g *Grant, anonymous bool) error {
+		if g.Name == "" {
+			return fmt.Errorf("grant without a name")
+		}
+		if names[g.Name] {
+			return fmt.Errorf("duplicate grant %q", g.Name)
+		}
+		names[g.Name] = true
+
+		if hash, err := hex.DecodeString(g.TokenSHA256); !anonymous && (err != nil || len(hash) != sha256.Size) {
+			return fmt.Errorf("grant %q: token_sha256 must be 64 hex digits", g.Name)
+		}
+		if len(g.Sources) == 0 {
+			return fmt.Errorf("grant %q: no sources", g.Name)
+		}
+		for _, flag := range g.Flags {
+			if !contains(GrantFlags, flag) {
+				return fmt.Errorf("grant %q: unknown flag %q, expected one of %v", g.Name, flag, GrantFlags)
+			}
+		}
+		if g.Rate != nil {
+			if err := g.Rate.Validate(); err != nil {
+				return fmt.Errorf("grant %q: %v", g.Name, err)
+			}
+		}
+		return nil
+	}
+
+	for i := range a.Grants {
+		if err := check(&a.Grants[i], false); err != nil {
+			return err
+		}
+	}
+	if a.Anonymous != nil {
+		if err := check(a.Anonymous, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finds the grant for a token; an empty token gets the anonymous grant
+func (a *Access) Lookup(token string) (*Grant, bool) {
+	if token == "" {
+		return a.Anonymous, a.Anonymous != nil
+	}
+	sum := sha256.Sum256([]byte(token))
+	for i := range a.Grants {
+		want, err := hex.DecodeString(a.Grants[i].TokenSHA256)
+		if err == nil && subtle.ConstantTimeCompare(sum[:], want) == 1 {
+			return &a.Grants[i], true
+		}
+	}
+	return nil, false
+}
+
+// reports whether the grant covers a source
+func (g *Grant) AllowsSource(name string) bool {
+	return contains(g.Sources, "*") || contains(g.Sources, name)
+}
+
+// reports whether the grant allows a flag such as -i
+func (g *Grant) AllowsFlag(flag string) bool {
+	if len(g.Flags) == 0 || contains(g.Flags, flag) {
+		return true
+	}
+	return (flag == "-A" || flag == "-B") && contains(g.Flags, "-C")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
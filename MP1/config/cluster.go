@@ -0,0 +1,225 @@
+package config
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// where the programs look for the cluster file, relative to main/, startup/ and tests/
+const DefaultClusterPath = "../cluster.json"
+
+// one machine in the cluster
+type Node struct {
+	ID      int               `json:"id"`
+	Address string            `json:"address"`  // host:port of the query server
+	SSHHost string            `json:"ssh_host"` // host:port used by startup
+	Sources []Source          `json:"sources"`  // logs the node's server should serve
+	Labels  map[string]string `json:"labels"`
+	TLS     *TLS              `json:"tls"`    // the server's certificate and the CA for client certificates
+	Access  string            `json:"access"` // access policy file for the node's server, see Access
+}
+
+// the machines a client, startup and the tests talk to
+type Cluster struct {
+	Name      string `json:"name"`
+	SSHUser   string `json:"ssh_user"`
+	RemoteDir string `json:"remote_dir"` // checkout of this repo on every node
+	Nodes     []Node `json:"nodes"`
+	TLS       *TLS   `json:"tls"` // the CA clients trust and the certificate they present
+}
+
+// reads a cluster description from a JSON file, e.g.
+//
+//	{
+//	  "name": "local",
+//	  "ssh_user": "me",
+//	  "remote_dir": "~/cs-425-mp-1",
+//	  "nodes": [
+//	    {"id": 1, "address": "localhost:4425", "ssh_host": "localhost:22",
+//	     "sources": [{"name": "log", "paths": ["../log/vm1.log"]}],
+//	     "labels": {"role": "web"}}
+//	  ]
+//	}
+//
+// with "tls" set on the cluster and its nodes, clients and servers use mutual
+// TLS, see the certgen program
+func LoadCluster(path string) (*Cluster, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Cluster
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("cluster %s: %v", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("cluster %s: %v", path, err)
+	}
+	return &c, nil
+}
+
+// checks that node ids are unique and every node has a usable address
+func (c *Cluster) Validate() error {
+	if len(c.Nodes) == 0 {
+		return fmt.Errorf("no nodes")
+	}
+
+	seen := make(map[int]bool, len(c.Nodes))
+	for _, n := range c.Nodes {
+		if n.ID <= 0 {
+			return fmt.Errorf("node %q needs a positive id", n.Address)
+		}
+		if seen[n.ID] {
+			return fmt.Errorf("duplicate node id %d", n.ID)
+		}
+		seen[n.ID] = true
+
+		if _, _, err := net.SplitHostPort(n.Address); err != nil {
+			return fmt.Errorf("node %d: bad address %q: %v", n.ID, n.Address, err)
+		}
+		names := make(map[string]bool, len(n.Sources))
+		for _, src := range n.Sources {
+			if src.Name == "" || len(src.Paths) == 0 || names[src.Name] {
+				return fmt.Errorf("node %d: sources need unique names and at least one path", n.ID)
+			}
+			names[src.Name] = true
+		}
+	}
+	return nil
+}
+
+// looks up a node by id
+func (c *Cluster) Node(id int) (Node, bool) {
+	for _, n := range c.Nodes {
+		if n.ID == id {
+			return n, true
+		}
+	}
+	return Node{}, false
+}
+
+// returns the nodes picked by a spec such as "1-4" or "1,3,7-9", in cluster order
+// an empty spec picks every node
+func (c *Cluster) Select(spec string) ([]Node, error) {
+	if spec == "" {
+		return c.Nodes, nil
+	}
+
+	want := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node %q in %q", part, spec)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("invalid node range %q in %q", part, spec)
+			}
+		}
+		for id := first; id <= last; id++ {
+			want[id] = true
+		}
+	}
+
+	var nodes []Node
+	for _, n := range c.Nodes {
+		if want[n.ID] {
+			nodes = append(nodes, n)
+			delete(want, n.ID)
+		}
+	}
+	if len(want) > 0 {
+		var missing []string
+		for id := range want {
+			missing = append(missing, strconv.Itoa(id))
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("no such nodes in cluster: %s", strings.Join(missing, ","))
+	}
+	return nodes, nil
+}
+
+// returns the nodes carrying every one of the given labels
+func (c *Cluster) WithLabels(labels map[string]string) []Node {
+	var nodes []Node
+	for _, n := range c.Nodes {
+		if n.HasLabels(labels) {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// reports whether the node carries every one of the given labels
+func (n Node) HasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if n.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// port the node's query server listens on
+func (n Node) Port() string {
+	_, port, _ := net.SplitHostPort(n.Address)
+	return port
+}
+
+// server flags that make the node serve its configured sources, e.g.
+// -port 4425 -source log=../log/vm1.log, plus its access policy and TLS files
+// if it has any
+func (n Node) ServerArgs() string {
+	args := []string{"-port", n.Port()}
+	for _, src := range n.Sources {
+		args = append(args, "-source", ShellQuote(src.Flag()))
+	}
+	if n.Access != "" {
+		args = append(args, "-access", ShellQuote(n.Access))
+	}
+	if n.TLS.Enabled() {
+		args = append(args, "-tls-cert", ShellQuote(n.TLS.Cert), "-tls-key", ShellQuote(n.TLS.Key))
+		if n.TLS.CA != "" {
+			args = append(args, "-tls-ca", ShellQuote(n.TLS.CA))
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// TLS settings for clients of the cluster, nil if the cluster does not use TLS
+func (c *Cluster) ClientTLS() (*tls.Config, error) {
+	if !c.TLS.Enabled() {
+		return nil, nil
+	}
+	return c.TLS.ClientConfig()
+}
+
+// quotes s for a POSIX shell
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// parses a label filter of the form key=value[,key=value...]
+func ParseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if value == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
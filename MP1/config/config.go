@@ -0,0 +1,274 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// a named set of log files; paths may be glob patterns
+// with Rotate set, paths are live logs instead and their rotated copies are
+// searched too, see RotateNumbered and RotateDated
+type Source struct {
+	Name   string   `json:"name"`
+	Paths  []string `json:"paths"`
+	Rotate string   `json:"rotate"`
+
+	audit bool // added by AddAuditSource
+}
+
+// settings for a single query server
+type Server struct {
+	Port    int      `json:"port"`
+	Sources []Source `json:"sources"`
+	Default []string `json:"default"` // sources searched when a query names none
+	TLS     *TLS     `json:"tls"`     // serve over TLS; with a CA, clients need a certificate
+	Access  *Access  `json:"access"`  // who may query what, nil lets anyone query anything
+
+	// every query is recorded in Audit, which is rotated after AuditMaxMB
+	// keeping AuditKeep old files, and served as the source AuditSource
+	Audit      string `json:"audit"`
+	AuditMaxMB int    `json:"audit_max_mb"`
+	AuditKeep  int    `json:"audit_keep"`
+
+	Limits Limits `json:"limits"`
+	Rate   *Rate  `json:"rate"` // per caller, nil is unlimited; grants can set their own
+}
+
+// a token bucket: callers may send PerSecond queries a second on average
+// and up to Burst at once, Burst defaults to PerSecond rounded up
+type Rate struct {
+	PerSecond float64 `json:"per_second"`
+	Burst     int     `json:"burst"`
+}
+
+// checks the rate and fills in the default burst
+func (r *Rate) Validate() error {
+	if r.PerSecond <= 0 || r.Burst < 0 {
+		return fmt.Errorf("rate needs a positive per_second and a burst of at least 0")
+	}
+	if r.Burst == 0 {
+		r.Burst = int(math.Ceil(r.PerSecond))
+	}
+	return nil
+}
+
+// how much work a server takes on, at once and per query
+type Limits struct {
+	Queries int `json:"queries"` // queries running at once, 0 uses the number of CPUs
+	Queue   int `json:"queue"`   // queries waiting for a slot, more are refused; 0 uses 4 per slot
+	Follows int `json:"follows"` // subscriptions open at once, more are refused; 0 uses 4 per slot
+
+	// per query caps; a query that reads ScanMB stops with partial results,
+	// one that reaches ReturnMB or Lines is truncated, a subscription ends
+	// there; 0 is unlimited
+	ScanMB   int `json:"scan_mb"`
+	ReturnMB int `json:"return_mb"`
+	Lines    int `json:"lines"`
+}
+
+// the source a server serves its own audit log as; it is never searched by
+// default and must be named with --source audit
+const AuditSource = "audit"
+
+// reads a server config from a JSON file, e.g.
+//
+//	{
+//	  "port": 4425,
+//	  "sources": [
+//	    {"name": "app", "paths": ["../log/vm1.log"]},
+//	    {"name": "access", "paths": ["/var/log/apache2/access.log"], "rotate": "numbered"}
+//	  ],
+//	  "default": ["app"],
+//	  "limits": {"queries": 4, "queue": 16, "scan_mb": 4096, "return_mb": 64},
+//	  "rate": {"per_second": 2, "burst": 10},
+//	  "tls": {"cert": "../certs/node-01.crt", "key": "../certs/node-01.key", "ca": "../certs/ca.crt"}
+//	}
+func LoadServer(path string) (*Server, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Server
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// checks that sources are named uniquely and that defaults refer to them
+func (c *Server) Validate() error {
+	seen := make(map[string]bool, len(c.Sources))
+	for _, src := range c.Sources {
+		if src.Name == "" {
+			return fmt.Errorf("source with paths %v has no name", src.Paths)
+		}
+		if src.Name == AuditSource && !src.audit {
+			return fmt.Errorf("source name %q is reserved for the audit log", src.Name)
+		}
+		if seen[src.Name] {
+			return fmt.Errorf("duplicate source %q", src.Name)
+		}
+		if len(src.Paths) == 0 {
+			return fmt.Errorf("source %q has no paths", src.Name)
+		}
+		if src.Rotate != "" {
+			if rotatedNames[src.Rotate] == nil {
+				return fmt.Errorf("source %q: unknown rotation %q, expected %s or %s", src.Name, src.Rotate, RotateNumbered, RotateDated)
+			}
+			for _, path := range src.Paths {
+				if strings.ContainsAny(path, "*?[") {
+					return fmt.Errorf("source %q: rotated path %q cannot be a glob pattern", src.Name, path)
+				}
+			}
+		}
+		seen[src.Name] = true
+	}
+	for _, name := range c.Default {
+		if !seen[name] {
+			return fmt.Errorf("default source %q is not defined", name)
+		}
+	}
+	l := c.Limits
+	if l.Queries < 0 || l.Queue < 0 || l.Follows < 0 || l.ScanMB < 0 || l.ReturnMB < 0 || l.Lines < 0 {
+		return fmt.Errorf("limits cannot be negative")
+	}
+	if c.Rate != nil {
+		if err := c.Rate.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Access != nil {
+		return c.Access.Validate()
+	}
+	return nil
+}
+
+// looks up a source by name
+func (c *Server) Source(name string) (Source, bool) {
+	for _, src := range c.Sources {
+		if src.Name == name {
+			return src, true
+		}
+	}
+	return Source{}, false
+}
+
+// names of the sources searched when a query names none
+// falls back to every source but the audit log if no default is configured
+func (c *Server) DefaultSources() []string {
+	if len(c.Default) > 0 {
+		return c.Default
+	}
+	var names []string
+	for _, src := range c.Sources {
+		if !src.audit {
+			names = append(names, src.Name)
+		}
+	}
+	return names
+}
+
+// serves the audit log and its rotated files as the source AuditSource
+func (c *Server) AddAuditSource() {
+	c.Sources = append(c.Sources, Source{
+		Name:   AuditSource,
+		Paths:  []string{c.Audit},
+		Rotate: RotateNumbered,
+		audit:  true,
+	})
+}
+
+// finds the configured source a file path belongs to, comparing cleaned absolute
+// paths so ./x.log and x.log match; returns the source and the file as the source
+// spells it, ok is false if no source contains the file
+func (c *Server) Owner(file string) (src Source, path string, ok bool, err error) {
+	want, err := filepath.Abs(file)
+	if err != nil {
+		return Source{}, "", false, err
+	}
+	for _, src := range c.Sources {
+		files, err := src.Files()
+		if err != nil {
+			return Source{}, "", false, err
+		}
+		for _, f := range files {
+			if abs, err := filepath.Abs(f); err == nil && abs == want {
+				return src, f, true, nil
+			}
+		}
+	}
+	return Source{}, "", false, nil
+}
+
+// lists the source's files: glob patterns expanded and sorted, or with a
+// rotation scheme each log's history, oldest first
+// plain paths are kept even if missing so the caller can report them
+func (s Source) Files() ([]string, error) {
+	histories, err := s.Histories()
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, h := range histories {
+		files = append(files, h...)
+	}
+	return files, nil
+}
+
+// expands the source's glob patterns into a sorted list of files
+func (s Source) globFiles() ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+
+	for _, pattern := range s.Paths {
+		if !strings.ContainsAny(pattern, "*?[") {
+			if !seen[pattern] {
+				seen[pattern] = true
+				files = append(files, pattern)
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %v", s.Name, err)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	return files, nil
+}
+
+// parses a -source flag value of the form name[:rotation]=path[,path...],
+// e.g. app:numbered=/var/log/app.log
+func ParseSourceFlag(value string) (Source, error) {
+	name, paths, ok := strings.Cut(value, "=")
+	if !ok || name == "" || paths == "" {
+		return Source{}, fmt.Errorf("invalid source %q, expected name[:rotation]=path[,path...]", value)
+	}
+	name, rotate, _ := strings.Cut(name, ":")
+	return Source{Name: name, Paths: strings.Split(paths, ","), Rotate: rotate}, nil
+}
+
+// the source as a -source flag value, see ParseSourceFlag
+func (s Source) Flag() string {
+	name := s.Name
+	if s.Rotate != "" {
+		name += ":" + s.Rotate
+	}
+	return name + "=" + strings.Join(s.Paths, ",")
+}
@@ -0,0 +1,33 @@
+package config
+
+import "testing"
+
+func TestValidateLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		ok     bool
+	}{
+		{"defaults", Limits{}, true},
+		{"all set", Limits{Queries: 4, Queue: 16, Follows: 8, ScanMB: 4096, ReturnMB: 64, Lines: 1000}, true},
+		{"negative queries", Limits{Queries: -1}, false},
+		{"negative queue", Limits{Queue: -1}, false},
+		{"negative follows", Limits{Follows: -1}, false},
+		{"negative scan", Limits{ScanMB: -1}, false},
+		{"negative return", Limits{ReturnMB: -1}, false},
+		{"negative lines", Limits{Lines: -1}, false},
+	}
+	for _, tt := range tests {
+		cfg := Server{
+			Sources: []Source{{Name: "app", Paths: []string{"vm1.log"}}},
+			Limits:  tt.limits,
+		}
+		err := cfg.Validate()
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: accepted %+v", tt.name, tt.limits)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rotation schemes a source can declare
+const (
+	// logrotate's default: app.log.1 is the newest rotated copy, app.log.2 the next, ...
+	RotateNumbered = "numbered"
+	// logrotate's dateext: app.log-20261018 or app.log.2026-10-18, oldest date first
+	RotateDated = "dated"
+)
+
+// what may follow a live log's path in the name of its rotated copies,
+// with an optional compression suffix
+var rotatedNames = map[string]*regexp.Regexp{
+	RotateNumbered: regexp.MustCompile(`^\.([0-9]+)(\.(gz|zst|bz2))?$`),
+	RotateDated:    regexp.MustCompile(`^[.-]([0-9]{4}-?[0-9]{2}-?[0-9]{2}([-_]?[0-9]{2,6})?)(\.(gz|zst|bz2))?$`),
+}
+
+// a live log and its rotated copies, oldest first, ending with the live log
+type History []string
+
+// the histories of the source's logs in the order of its paths; without a
+// rotation scheme every file is a history of its own
+func (s Source) Histories() ([]History, error) {
+	if s.Rotate == "" {
+		files, err := s.globFiles()
+		if err != nil {
+			return nil, err
+		}
+		histories := make([]History, len(files))
+		for i, f := range files {
+			histories[i] = History{f}
+		}
+		return histories, nil
+	}
+
+	histories := make([]History, 0, len(s.Paths))
+	for _, path := range s.Paths {
+		rotated, err := rotatedFiles(path, s.Rotate)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %v", s.Name, err)
+		}
+		histories = append(histories, append(rotated, path))
+	}
+	return histories, nil
+}
+
+// finds the rotated copies of path, oldest first
+func rotatedFiles(path, scheme string) ([]string, error) {
+	pattern := rotatedNames[scheme]
+	var candidates []string
+	for _, sep := range []string{".", "-"} {
+		matches, err := filepath.Glob(path + sep + "*")
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, matches...)
+	}
+
+	type entry struct {
+		file string
+		key  string // sorts oldest first
+	}
+	var copies []entry
+	for _, file := range candidates {
+		m := pattern.FindStringSubmatch(strings.TrimPrefix(file, path))
+		if m == nil {
+			continue
+		}
+		key := strings.NewReplacer("-", "", "_", "").Replace(m[1])
+		if scheme == RotateNumbered {
+			// higher numbers are older; pad so they sort as numbers
+			n, _ := strconv.Atoi(m[1])
+			key = fmt.Sprintf("%020d", 1<<62-n)
+		}
+		copies = append(copies, entry{file, key})
+	}
+	sort.Slice(copies, func(i, j int) bool {
+		if copies[i].key != copies[j].key {
+			return copies[i].key < copies[j].key
+		}
+		return copies[i].file < copies[j].file
+	})
+
+	files := make([]string, len(copies))
+	for i, c := range copies {
+		files[i] = c.file
+	}
+	return files, nil
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRotatedFiles(t *testing.T) {
+	tests := []struct {
+		scheme string
+		files  []string // next to app.log
+		want   []string // oldest first
+	}{
+		{RotateNumbered,
+			[]string{"app.log.1", "app.log.2.gz", "app.log.10", "app.log.3.zst", "app.log.bak", "app.log-20261018", "app.logger"},
+			[]string{"app.log.10", "app.log.3.zst", "app.log.2.gz", "app.log.1"}},
+		{RotateNumbered, []string{"other.log.1"}, nil},
+		{RotateDated,
+			[]string{"app.log-20261018", "app.log-20261001.gz", "app.log.2026-10-05", "app.log-20261018-1200.bz2", "app.log.1", "app.log-2026"},
+			[]string{"app.log-20261001.gz", "app.log.2026-10-05", "app.log-20261018", "app.log-20261018-1200.bz2"}},
+		// the same day compressed or not sorts by name
+		{RotateDated,
+			[]string{"app.log-20261002.gz", "app.log-20261002", "app.log-20261001"},
+			[]string{"app.log-20261001", "app.log-20261002", "app.log-20261002.gz"}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		live := filepath.Join(dir, "app.log")
+		for _, name := range append(tt.files, "app.log") {
+			if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files, err := rotatedFiles(live, tt.scheme)
+		if err != nil {
+			t.Fatalf("rotatedFiles(%s): %v", tt.scheme, err)
+		}
+		var got []string
+		for _, f := range files {
+			got = append(got, filepath.Base(f))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rotatedFiles(%s) of %q = %q, want %q", tt.scheme, tt.files, got, tt.want)
+		}
+	}
+}
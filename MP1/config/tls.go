@@ -0,0 +1,84 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// certificate files for TLS; on a server CA verifies client certificates,
+// on a client it is the only CA trusted for server certificates
+type TLS struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	CA   string `json:"ca"`
+}
+
+// reports whether any TLS files are configured
+func (t *TLS) Enabled() bool {
+	return t != nil && (t.Cert != "" || t.Key != "" || t.CA != "")
+}
+
+// settings for a server: its own certificate, and if CA is set, clients must
+// present a certificate signed by it
+func (t *TLS) ServerConfig() (*tls.Config, error) {
+	if t.Cert == "" || t.Key == "" {
+		return nil, fmt.Errorf("tls: a server needs both cert and key")
+	}
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %v", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.CA != "" {
+		pool, err := loadCA(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// settings for a client: trust only servers signed by CA and, if Cert and Key
+// are set, present them to servers that ask for a client certificate
+func (t *TLS) ClientConfig() (*tls.Config, error) {
+	if t.CA == "" {
+		return nil, fmt.Errorf("tls: a client needs the ca that signed the servers")
+	}
+	pool, err := loadCA(t.CA)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCA(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("tls: no certificates in %s", path)
+	}
+	return pool, nil
+}
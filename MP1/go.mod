@@ -3,6 +3,7 @@ module gb4
 go 1.24.6
 
 require (
+	github.com/klauspost/compress v1.18.0
 	golang.org/x/crypto v0.42.0
 	mvdan.cc/sh/v3 v3.12.0
 )
@@ -0,0 +1,536 @@
+package grep
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// flags supported by the in-process matcher, mirroring the grep options we use
+type Options struct {
+	IgnoreCase  bool // -i
+	Invert      bool // -v
+	LineNumbers bool // -n
+	Extended    bool // -E
+	Fixed       bool // -F
+	WordRegexp  bool // -w
+	Count       bool // -c
+	Before      int  // -B NUM
+	After       int  // -A NUM
+	MaxCount    int  // -m NUM, 0 means unlimited unless HasMaxCount is set
+	HasMaxCount bool // -m was given, so a MaxCount of 0 selects no line
+}
+
+// reports whether -m limits the selected lines
+func (o Options) Limited() bool {
+	return o.MaxCount > 0 || o.HasMaxCount
+}
+
+// a single line of output, either a selected line or a context line around one
+type Line struct {
+	Number  int
+	Offset  int64
+	Text    string
+	Context bool
+}
+
+// totals gathered while scanning a single input
+type Stats struct {
+	Matches      int
+	BytesScanned int64
+}
+
+// compiled form of a pattern plus the options it was compiled with
+type Matcher struct {
+	opts  Options
+	re    *regexp.Regexp
+	fixed []byte
+}
+
+// builds a matcher for the given pattern
+// the pattern uses basic regular expression syntax unless -E or -F is set
+func Compile(pattern string, opts Options) (*Matcher, error) {
+	m := &Matcher{opts: opts}
+
+	// plain substring search is enough for -F without -i or -w
+	if opts.Fixed && !opts.IgnoreCase && !opts.WordRegexp && !strings.Contains(pattern, "\n") {
+		m.fixed = []byte(pattern)
+		return m, nil
+	}
+
+	var expr string
+	switch {
+	case opts.Fixed:
+		alts := strings.Split(pattern, "\n")
+		for i, alt := range alts {
+			alts[i] = regexp.QuoteMeta(alt)
+		}
+		expr = strings.Join(alts, "|")
+	case opts.Extended:
+		expr = translate(pattern, false)
+	default:
+		expr = translate(pattern, true)
+	}
+
+	if opts.WordRegexp {
+		// like grep, the match must not touch a word character on either
+		// side; \b would also reject matches that start or end with a
+		// non-word character, such as .foo
+		expr = `(?:^|\W)(?:` + expr + `)(?:\W|$)`
+	}
+	if opts.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("grep: invalid pattern %q: %v", pattern, err)
+	}
+	m.re = re
+	return m, nil
+}
+
+// returns the options the matcher was compiled with
+func (m *Matcher) Options() Options {
+	return m.opts
+}
+
+// reports whether a line is selected, taking -v into account
+func (m *Matcher) Match(line []byte) bool {
+	var found bool
+	if m.re != nil {
+		found = m.re.Match(line)
+	} else {
+		found = bytes.Contains(line, m.fixed)
+	}
+	return found != m.opts.Invert
+}
+
+const (
+	// how many lines are scanned between checks for cancellation
+	checkEvery = 1024
+	// most before-context lines made room for before any are read
+	maxPrealloc = 1024
+)
+
+// limits a scan to part of an input
+type Region struct {
+	// where r starts in the file when it does not start at the top:
+	// Line is the number of lines before it, Offset its byte offset
+	Line   int
+	Offset int64
+
+	// if set, called for every line before matching; lines it does not keep are
+	// neither matched nor used as context, stop ends the scan at that line
+	Keep func(text []byte) (keep, stop bool)
+}
+
+// reads r line by line and calls emit for every selected line and its context
+// lines are emitted in file order; the scan stops early if emit returns an error
+// or ctx is done, in which case ctx.Err() is returned
+func (m *Matcher) Scan(ctx context.Context, r io.Reader, emit func(Line) error) (Stats, error) {
+	return m.ScanRegion(ctx, r, Region{}, emit)
+}
+
+// like Scan, but only over the lines region keeps, numbered from where r starts
+func (m *Matcher) ScanRegion(ctx context.Context, r io.Reader, region Region, emit func(Line) error) (Stats, error) {
+	var stats Stats
+	if m.opts.Limited() && m.opts.MaxCount == 0 {
+		// -m 0, like grep, does not even read the input
+		return stats, nil
+	}
+	reader := bufio.NewReaderSize(r, 64*1024)
+
+	// the most recent unselected lines, flushed as before-context
+	before := newRing(m.opts.Before)
+	afterLeft := 0
+	lastEmitted := region.Line
+	lineNo := region.Line
+	offset := region.Offset
+
+	for {
+		raw, readErr := reader.ReadBytes('\n')
+		if len(raw) == 0 && readErr != nil {
+			if readErr == io.EOF {
+				return stats, nil
+			}
+			return stats, readErr
+		}
+
+		lineNo++
+		if lineNo%checkEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return stats, err
+			}
+		}
+		start := offset
+		offset += int64(len(raw))
+		stats.BytesScanned += int64(len(raw))
+		text := bytes.TrimSuffix(bytes.TrimSuffix(raw, []byte("\n")), []byte("\r"))
+
+		if region.Keep != nil {
+			keep, stop := region.Keep(text)
+			if stop {
+				return stats, nil
+			}
+			if !keep {
+				if readErr != nil {
+					if readErr == io.EOF {
+						return stats, nil
+					}
+					return stats, readErr
+				}
+				continue
+			}
+		}
+
+		done := m.opts.Limited() && stats.Matches >= m.opts.MaxCount
+
+		if !done && m.Match(text) {
+			if err := before.flush(lastEmitted, emit); err != nil {
+				return stats, err
+			}
+
+			stats.Matches++
+			lastEmitted = lineNo
+			afterLeft = m.opts.After
+			if err := emit(Line{Number: lineNo, Offset: start, Text: string(text)}); err != nil {
+				return stats, err
+			}
+		} else if afterLeft > 0 {
+			afterLeft--
+			lastEmitted = lineNo
+			if err := emit(Line{Number: lineNo, Offset: start, Text: string(text), Context: true}); err != nil {
+				return stats, err
+			}
+		} else if done {
+			// -m reached and trailing context printed
+			return stats, nil
+		} else if m.opts.Before > 0 {
+			before.push(lineNo, start, text)
+		}
+
+		if readErr != nil {
+			if readErr == io.EOF {
+				return stats, nil
+			}
+			return stats, readErr
+		}
+	}
+}
+
+// a circular buffer of the last size unselected lines; text is kept as read
+// and only made a string for the lines flushed as context
+type ring struct {
+	lines []ringLine
+	size  int // most lines kept, the buffer grows up to it as lines arrive
+	head  int // index of the oldest line
+	count int
+}
+
+type ringLine struct {
+	number int
+	offset int64
+	text   []byte
+}
+
+func newRing(size int) *ring {
+	return &ring{lines: make([]ringLine, 0, min(size, maxPrealloc)), size: size}
+}
+
+// keeps a line, dropping the oldest once size lines are kept
+// text must not be changed afterwards, the ring does not copy it
+func (r *ring) push(number int, offset int64, text []byte) {
+	line := ringLine{number: number, offset: offset, text: text}
+	switch {
+	case r.count < len(r.lines):
+		r.lines[(r.head+r.count)%len(r.lines)] = line
+		r.count++
+	case len(r.lines) < r.size:
+		// head is still 0, it only moves once size lines are kept
+		r.lines = append(r.lines, line)
+		r.count++
+	default:
+		r.lines[r.head] = line
+		r.head = (r.head + 1) % len(r.lines)
+	}
+}
+
+// emits the kept lines after line after, oldest first, and empties the ring
+func (r *ring) flush(after int, emit func(Line) error) error {
+	for i := 0; i < r.count; i++ {
+		line := r.lines[(r.head+i)%len(r.lines)]
+		if line.number <= after {
+			continue
+		}
+		if err := emit(Line{Number: line.number, Offset: line.offset, Text: string(line.text), Context: true}); err != nil {
+			return err
+		}
+	}
+	r.head, r.count = 0, 0
+	return nil
+}
+
+// formats a line the way grep prints it, e.g. "file:12:text" or "file-13-text" for context
+func FormatLine(file string, line Line, lineNumbers bool) string {
+	sep := ":"
+	if line.Context {
+		sep = "-"
+	}
+
+	var b strings.Builder
+	if file != "" {
+		b.WriteString(file)
+		b.WriteString(sep)
+	}
+	if lineNumbers {
+		fmt.Fprintf(&b, "%d%s", line.Number, sep)
+	}
+	b.WriteString(line.Text)
+	return b.String()
+}
+
+// rewrites a POSIX basic or extended regular expression into RE2 syntax
+//
+// in basic syntax \| \+ \? \( \) \{ \} are operators and the bare characters
+// are literals, which is the opposite of RE2; both syntaxes accept \< and \>
+// a * with nothing before it to repeat is a literal in basic syntax
+func translate(pattern string, basic bool) string {
+	var b strings.Builder
+	inBracket := false
+	// nothing to repeat yet: the start, or just after ^, \( or \|
+	atStart := true
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		start := atStart
+		atStart = false
+
+		if inBracket {
+			b.WriteByte(c)
+			// a leading ] or ^] is part of the set, not its end
+			if c == ']' && !(pattern[i-1] == '[' || (pattern[i-1] == '^' && i >= 2 && pattern[i-2] == '[')) {
+				inBracket = false
+			}
+			// keep [:class:] sequences intact
+			if c == '[' && i+1 < len(pattern) && pattern[i+1] == ':' {
+				end := strings.Index(pattern[i+2:], ":]")
+				if end >= 0 {
+					b.WriteString(pattern[i+1 : i+2+end+2])
+					i += end + 3
+				}
+			}
+			continue
+		}
+
+		switch {
+		case c == '[':
+			inBracket = true
+			b.WriteByte(c)
+		case c == '\\' && i+1 < len(pattern):
+			next := pattern[i+1]
+			i++
+			switch {
+			case next == '<' || next == '>':
+				b.WriteString(`\b`)
+			case basic && strings.IndexByte("|+?(){}", next) >= 0:
+				b.WriteByte(next)
+				atStart = next == '(' || next == '|'
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(next)
+			}
+		case basic && strings.IndexByte("|+?(){}", c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case basic && c == '*' && start:
+			b.WriteString(`\*`)
+		case basic && c == '^' && start:
+			b.WriteByte(c)
+			atStart = true
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// returned when the arguments contain neither -e nor a pattern operand
+var ErrNoPattern = errors.New("grep: no pattern given")
+
+// parses grep style arguments (without the leading "grep") into options,
+// the pattern and any file operands
+func ParseArgs(args []string) (Options, string, []string, error) {
+	var opts Options
+	var patterns []string
+	var operands []string
+	hasPattern := false
+
+	number := func(flag string, value string) (int, error) {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("grep: invalid argument %q for %s", value, flag)
+		}
+		return n, nil
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		// everything after "--" is an operand
+		if arg == "--" {
+			operands = append(operands, args[i+1:]...)
+			break
+		}
+
+		if strings.HasPrefix(arg, "--") {
+			name, value, hasValue := strings.Cut(arg[2:], "=")
+			takeValue := func() (string, error) {
+				if hasValue {
+					return value, nil
+				}
+				if i+1 >= len(args) {
+					return "", fmt.Errorf("grep: option --%s requires an argument", name)
+				}
+				i++
+				return args[i], nil
+			}
+
+			switch name {
+			case "ignore-case":
+				opts.IgnoreCase = true
+			case "invert-match":
+				opts.Invert = true
+			case "line-number":
+				opts.LineNumbers = true
+			case "extended-regexp":
+				opts.Extended = true
+			case "fixed-strings":
+				opts.Fixed = true
+			case "basic-regexp":
+				opts.Extended, opts.Fixed = false, false
+			case "word-regexp":
+				opts.WordRegexp = true
+			case "count":
+				opts.Count = true
+			case "after-context", "before-context", "context", "max-count":
+				v, err := takeValue()
+				if err != nil {
+					return opts, "", nil, err
+				}
+				n, err := number("--"+name, v)
+				if err != nil {
+					return opts, "", nil, err
+				}
+				switch name {
+				case "after-context":
+					opts.After = n
+				case "before-context":
+					opts.Before = n
+				case "context":
+					opts.Before, opts.After = n, n
+				case "max-count":
+					opts.MaxCount, opts.HasMaxCount = n, true
+				}
+			case "regexp":
+				v, err := takeValue()
+				if err != nil {
+					return opts, "", nil, err
+				}
+				patterns = append(patterns, v)
+				hasPattern = true
+			default:
+				return opts, "", nil, fmt.Errorf("grep: unrecognized option '--%s'", name)
+			}
+			continue
+		}
+
+		if len(arg) < 2 || arg[0] != '-' {
+			operands = append(operands, arg)
+			continue
+		}
+
+		// short options may be combined, e.g. -in or -A3
+		for j := 1; j < len(arg); j++ {
+			c := arg[j]
+			switch c {
+			case 'i', 'y':
+				opts.IgnoreCase = true
+			case 'v':
+				opts.Invert = true
+			case 'n':
+				opts.LineNumbers = true
+			case 'E':
+				opts.Extended = true
+			case 'F':
+				opts.Fixed = true
+			case 'G':
+				opts.Extended, opts.Fixed = false, false
+			case 'w':
+				opts.WordRegexp = true
+			case 'c':
+				opts.Count = true
+			case 'A', 'B', 'C', 'm', 'e':
+				value := arg[j+1:]
+				if value == "" {
+					if i+1 >= len(args) {
+						return opts, "", nil, fmt.Errorf("grep: option requires an argument -- '%c'", c)
+					}
+					i++
+					value = args[i]
+				}
+				if c == 'e' {
+					patterns = append(patterns, value)
+					hasPattern = true
+					j = len(arg)
+					continue
+				}
+				n, err := number("-"+string(c), value)
+				if err != nil {
+					return opts, "", nil, err
+				}
+				switch c {
+				case 'A':
+					opts.After = n
+				case 'B':
+					opts.Before = n
+				case 'C':
+					opts.Before, opts.After = n, n
+				case 'm':
+					opts.MaxCount, opts.HasMaxCount = n, true
+				}
+				j = len(arg)
+			default:
+				return opts, "", nil, fmt.Errorf("grep: invalid option -- '%c'", c)
+			}
+		}
+	}
+
+	if !hasPattern {
+		if len(operands) == 0 {
+			return opts, "", nil, ErrNoPattern
+		}
+		patterns = append(patterns, operands[0])
+		operands = operands[1:]
+	}
+
+	return opts, joinPatterns(patterns, opts), operands, nil
+}
+
+// multiple -e patterns are alternatives; -F takes them newline separated
+func joinPatterns(patterns []string, opts Options) string {
+	if len(patterns) == 1 || opts.Fixed {
+		return strings.Join(patterns, "\n")
+	}
+	sep := `\|`
+	if opts.Extended {
+		sep = "|"
+	}
+	return strings.Join(patterns, sep)
+}
@@ -0,0 +1,161 @@
+package grep
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		pattern string
+		basic   bool
+		want    string
+	}{
+		{`a|b`, true, `a\|b`},
+		{`a\|b`, true, `a|b`},
+		{`a|b`, false, `a|b`},
+		{`a+b?`, true, `a\+b\?`},
+		{`a\+b\?`, true, `a+b?`},
+		{`\(ab\)\{2\}`, true, `(ab){2}`},
+		{`(ab){2}`, false, `(ab){2}`},
+		{`\<foo\>`, true, `\bfoo\b`},
+		{`\<foo\>`, false, `\bfoo\b`},
+		{`[]a]`, true, `[]a]`},
+		{`[^]a]+`, false, `[^]a]+`},
+		{`[[:digit:]]+`, false, `[[:digit:]]+`},
+		{`[(|)]`, true, `[(|)]`},
+		// a * with nothing to repeat is a literal in basic syntax
+		{`*foo`, true, `\*foo`},
+		{`^*foo`, true, `^\*foo`},
+		{`a\(*b\)`, true, `a(\*b)`},
+		{`a\|*b`, true, `a|\*b`},
+		{`a*b`, true, `a*b`},
+		{`[*]a`, true, `[*]a`},
+	}
+	for _, tt := range tests {
+		if got := translate(tt.pattern, tt.basic); got != tt.want {
+			t.Errorf("translate(%q, basic=%v) = %q, want %q", tt.pattern, tt.basic, got, tt.want)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		opts     Options
+		pattern  string
+		operands []string
+		err      bool
+	}{
+		{args: []string{"foo"}, pattern: "foo"},
+		{args: []string{"-in", "foo", "a.log"}, opts: Options{IgnoreCase: true, LineNumbers: true}, pattern: "foo", operands: []string{"a.log"}},
+		{args: []string{"-A3", "-B", "2", "foo"}, opts: Options{After: 3, Before: 2}, pattern: "foo"},
+		{args: []string{"-C", "1", "foo"}, opts: Options{After: 1, Before: 1}, pattern: "foo"},
+		{args: []string{"--context=4", "foo"}, opts: Options{After: 4, Before: 4}, pattern: "foo"},
+		{args: []string{"-m", "2", "foo"}, opts: Options{MaxCount: 2, HasMaxCount: true}, pattern: "foo"},
+		{args: []string{"-m0", "foo"}, opts: Options{HasMaxCount: true}, pattern: "foo"},
+		{args: []string{"--max-count", "0", "foo"}, opts: Options{HasMaxCount: true}, pattern: "foo"},
+		{args: []string{"-e", "a", "-e", "b"}, pattern: `a\|b`},
+		{args: []string{"-E", "-e", "a", "-e", "b"}, opts: Options{Extended: true}, pattern: "a|b"},
+		{args: []string{"-F", "-e", "a", "-e", "b"}, opts: Options{Fixed: true}, pattern: "a\nb"},
+		{args: []string{"-EG", "foo"}, pattern: "foo"},
+		{args: []string{"--", "-v", "x"}, pattern: "-v", operands: []string{"x"}},
+		{args: []string{"-e", "-v"}, pattern: "-v"},
+		{args: []string{"-A", "-1", "foo"}, err: true},
+		{args: []string{"-A"}, err: true},
+		{args: []string{"-r", "foo"}, err: true},
+		{args: []string{"--recursive", "foo"}, err: true},
+		{args: []string{"-i"}, err: true},
+	}
+	for _, tt := range tests {
+		opts, pattern, operands, err := ParseArgs(tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseArgs(%q) succeeded, want an error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseArgs(%q): %v", tt.args, err)
+			continue
+		}
+		sameOperands := len(operands) == 0 && len(tt.operands) == 0 || reflect.DeepEqual(operands, tt.operands)
+		if opts != tt.opts || pattern != tt.pattern || !sameOperands {
+			t.Errorf("ParseArgs(%q) = %+v, %q, %q; want %+v, %q, %q",
+				tt.args, opts, pattern, operands, tt.opts, tt.pattern, tt.operands)
+		}
+	}
+}
+
+// the lines selected from input, as grep -n would print them without a file
+func grepLines(t *testing.T, pattern string, opts Options, input string) []string {
+	t.Helper()
+	m, err := Compile(pattern, opts)
+	if err != nil {
+		t.Fatalf("Compile(%q): %v", pattern, err)
+	}
+	var out []string
+	_, err = m.Scan(context.Background(), strings.NewReader(input), func(line Line) error {
+		out = append(out, FormatLine("", line, true))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan(%q): %v", pattern, err)
+	}
+	return out
+}
+
+func TestMatch(t *testing.T) {
+	const input = "*foo\n.foo\nxfoo\nfoo bar\nfoo_x\n"
+	tests := []struct {
+		pattern string
+		opts    Options
+		want    []string
+	}{
+		{"foo", Options{WordRegexp: true}, []string{"1:*foo", "2:.foo", "4:foo bar"}},
+		{".foo", Options{WordRegexp: true}, []string{"1:*foo", "2:.foo", "3:xfoo"}},
+		{"FOO", Options{WordRegexp: true, IgnoreCase: true}, []string{"1:*foo", "2:.foo", "4:foo bar"}},
+		{"*foo", Options{}, []string{"1:*foo"}},
+		{"^*foo", Options{}, []string{"1:*foo"}},
+		{".foo", Options{Fixed: true}, []string{"2:.foo"}},
+		{"foo", Options{Invert: true}, nil},
+		{"bar|_x", Options{Extended: true}, []string{"4:foo bar", "5:foo_x"}},
+		{`bar\|_x`, Options{}, []string{"4:foo bar", "5:foo_x"}},
+	}
+	for _, tt := range tests {
+		got := grepLines(t, tt.pattern, tt.opts, input)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("grep %+v %q = %q, want %q", tt.opts, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestContextAndMaxCount(t *testing.T) {
+	const input = "a\nb\nhit 1\nc\nd\ne\nhit 2\nhit 3\nf\n"
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"plain", Options{}, []string{"3:hit 1", "7:hit 2", "8:hit 3"}},
+		{"-A1", Options{After: 1}, []string{"3:hit 1", "4-c", "7:hit 2", "8:hit 3", "9-f"}},
+		{"-B1", Options{Before: 1}, []string{"2-b", "3:hit 1", "6-e", "7:hit 2", "8:hit 3"}},
+		{"-B2 wrapping", Options{Before: 2}, []string{"1-a", "2-b", "3:hit 1", "5-d", "6-e", "7:hit 2", "8:hit 3"}},
+		{"-C2 overlapping", Options{Before: 2, After: 2}, []string{
+			"1-a", "2-b", "3:hit 1", "4-c", "5-d", "6-e", "7:hit 2", "8:hit 3", "9-f"}},
+		{"huge -B", Options{Before: 1 << 40}, []string{"1-a", "2-b", "3:hit 1", "4-c", "5-d", "6-e", "7:hit 2", "8:hit 3"}},
+		{"-m1", Options{MaxCount: 1, HasMaxCount: true}, []string{"3:hit 1"}},
+		{"-m1 -A1", Options{MaxCount: 1, HasMaxCount: true, After: 1}, []string{"3:hit 1", "4-c"}},
+		{"-m2", Options{MaxCount: 2, HasMaxCount: true}, []string{"3:hit 1", "7:hit 2"}},
+		{"-m0", Options{HasMaxCount: true}, nil},
+		{"unset -m", Options{MaxCount: 0}, []string{"3:hit 1", "7:hit 2", "8:hit 3"}},
+	}
+	for _, tt := range tests {
+		got := grepLines(t, "hit", tt.opts, input)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package logtime
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// a way of finding and parsing the timestamp in a log line
+type Layout struct {
+	Name   string
+	find   *regexp.Regexp // locates the timestamp, the first group is parsed if present
+	layout string         // Go reference layout for time.Parse
+	noYear bool           // the layout has no year, the current year is assumed
+}
+
+// layouts known by name; anything else given to NewParser is a Go reference layout
+var builtin = []Layout{
+	{
+		// apache common/combined log: [10/Oct/2000:13:55:36 -0700]
+		Name:   "apache",
+		find:   regexp.MustCompile(`\[(\d{2}/[A-Za-z]{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\]`),
+		layout: "02/Jan/2006:15:04:05 -0700",
+	},
+	{
+		// 2000-10-10T13:55:36Z or 2000-10-10T13:55:36.123+02:00
+		Name:   "rfc3339",
+		find:   regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:\d{2})`),
+		layout: time.RFC3339Nano,
+	},
+	{
+		// 2000-10-10 13:55:36, local time
+		Name:   "datetime",
+		find:   regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}`),
+		layout: "2006-01-02 15:04:05",
+	},
+	{
+		// Go's log package: 2000/10/10 13:55:36, local time
+		Name:   "golog",
+		find:   regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}`),
+		layout: "2006/01/02 15:04:05",
+	},
+	{
+		// syslog: Oct 10 13:55:36, local time in the current year
+		Name:   "syslog",
+		find:   regexp.MustCompile(`^[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}`),
+		layout: time.Stamp,
+		noYear: true,
+	},
+}
+
+// the layouts tried when none are configured, in order
+var Default = []string{"apache", "rfc3339", "datetime", "golog", "syslog"}
+
+// names of the built-in layouts
+func Names() []string {
+	names := make([]string, len(builtin))
+	for i, l := range builtin {
+		names[i] = l.Name
+	}
+	return names
+}
+
+// finds timestamps in log lines, trying each layout in turn
+type Parser struct {
+	layouts []Layout
+}
+
+// builds a parser from layout names (see Names) or Go reference layouts such
+// as "2006-01-02 15:04:05.000"; a Go layout must appear at the start of the line
+// with no names at all the Default layouts are used
+func NewParser(layouts []string) (*Parser, error) {
+	if len(layouts) == 0 {
+		layouts = Default
+	}
+
+	p := &Parser{}
+	for _, name := range layouts {
+		name = strings.TrimSpace(name)
+		if l, ok := lookup(name); ok {
+			p.layouts = append(p.layouts, l)
+			continue
+		}
+		if !strings.ContainsAny(name, "0123456789") {
+			return nil, fmt.Errorf("unknown time layout %q, use one of %s or a Go reference layout",
+				name, strings.Join(Names(), ", "))
+		}
+		p.layouts = append(p.layouts, Layout{Name: name, layout: name})
+	}
+	return p, nil
+}
+
+// parses a comma separated list of layouts, e.g. from a flag
+func ParseList(value string) (*Parser, error) {
+	if value == "" {
+		return NewParser(nil)
+	}
+	return NewParser(strings.Split(value, ","))
+}
+
+func lookup(name string) (Layout, bool) {
+	for _, l := range builtin {
+		if l.Name == name {
+			return l, true
+		}
+	}
+	return Layout{}, false
+}
+
+// returns the timestamp of a line, ok is false if no layout matches
+func (p *Parser) Parse(line string) (t time.Time, ok bool) {
+	for _, l := range p.layouts {
+		if t, ok := l.parse(line); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (l Layout) parse(line string) (time.Time, bool) {
+	var value string
+	switch {
+	case l.find == nil:
+		// custom layouts are matched against the start of the line
+		if len(line) < len(l.layout) {
+			return time.Time{}, false
+		}
+		value = line[:len(l.layout)]
+	default:
+		m := l.find.FindStringSubmatch(line)
+		if m == nil {
+			return time.Time{}, false
+		}
+		value = m[0]
+		if len(m) > 1 {
+			value = m[1]
+		}
+	}
+
+	t, err := time.ParseInLocation(l.layout, value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if l.noYear {
+		t = t.AddDate(time.Now().Year(), 0, 0)
+	}
+	return t, true
+}
+
+// layouts accepted for --since and --until, besides durations and clock times
+var boundLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"02/Jan/2006:15:04:05 -0700",
+}
+
+// parses the value of --since or --until relative to now:
+//   - "now"
+//   - a duration back from now such as 15m or 2h30m
+//   - a clock time today such as 14:00 or 14:15:30
+//   - a date and time such as 2025-09-01 14:00, 2025-09-01T14:00:00Z or
+//     01/Sep/2025:14:00:00 -0500
+//
+// times without a zone are local
+func ParseBound(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "now" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if clock, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			y, m, d := now.Date()
+			return time.Date(y, m, d, clock.Hour(), clock.Minute(), clock.Second(), 0, now.Location()), nil
+		}
+	}
+	for _, layout := range boundLayouts {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. 15m, 14:00, 2006-01-02 14:00 or an RFC 3339 time", value)
+}
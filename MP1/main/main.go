@@ -1,9 +1,56 @@
 package main
 
 import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
 	"gb4/client"
+	"gb4/config"
 )
 
 func main() {
-	client.Client()
+	clusterPath := flag.String("cluster", config.DefaultClusterPath, "path to the cluster file")
+	expr := flag.String("e", "", "run this grep command once and exit instead of starting the prompt")
+	format := flag.String("format", "text", "output of a one-shot query: text, json, ndjson, csv or summary")
+	timeout := flag.Duration("timeout", 30*time.Second, "deadline for a query on each node")
+	nodes := flag.String("nodes", "", "nodes for a one-shot query, e.g. 1-4 or 1,3,5 (default all)")
+	merge := flag.Bool("merge", false, "print lines from all nodes in timestamp order, tagged with their node")
+	layouts := flag.String("time-layout", "", "comma separated timestamp layouts for -merge and --since/--until: apache, rfc3339, datetime, golog, syslog or a Go layout (default all built-in)")
+	token := flag.String("token", os.Getenv("QUERIER_TOKEN"), "token for servers with an access policy (default $QUERIER_TOKEN)")
+	follow := flag.Bool("follow", false, "with -e, print new matching lines from every node as they are logged until ctrl-c")
+	status := flag.Bool("status", false, "print the status of the selected nodes and exit, 1 if any is down or not ready")
+	flag.Parse()
+
+	cluster, err := config.LoadCluster(*clusterPath)
+	if err != nil {
+		log.Fatalf("error loading cluster: %v", err)
+	}
+
+	if *status {
+		selected, err := cluster.Select(*nodes)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		os.Exit(client.PrintClusterStatus(cluster, selected, *token))
+	}
+
+	// one-shot mode for scripts: exit status tells matches / no match / partial / failed
+	if *expr != "" {
+		os.Exit(client.RunOnce(cluster, client.Options{
+			Expr:    *expr,
+			Format:  *format,
+			Timeout: *timeout,
+			Nodes:   *nodes,
+			Token:   *token,
+
+			Merge:       *merge,
+			TimeLayouts: *layouts,
+
+			Follow: *follow,
+		}))
+	}
+
+	client.Client(cluster, client.Options{Timeout: *timeout, Token: *token, Merge: *merge, TimeLayouts: *layouts})
 }
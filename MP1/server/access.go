@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gb4/api"
+	"gb4/config"
+	"gb4/grep"
+)
+
+// the grep flags a request uses, spelled as in a grant
+func requestFlags(opts grep.Options) []string {
+	used := []struct {
+		flag string
+		on   bool
+	}{
+		{"-i", opts.IgnoreCase},
+		{"-v", opts.Invert},
+		{"-n", opts.LineNumbers},
+		{"-c", opts.Count},
+		{"-w", opts.WordRegexp},
+		{"-E", opts.Extended},
+		{"-F", opts.Fixed},
+		{"-A", opts.After > 0},
+		{"-B", opts.Before > 0},
+		{"-m", opts.Limited()},
+	}
+
+	var flags []string
+	for _, u := range used {
+		if u.on {
+			flags = append(flags, u.flag)
+		}
+	}
+	return flags
+}
+
+// finds the grant for a token and the name it goes by in the audit log:
+// the grant's name, "anonymous" without a token or "unknown" for a token
+// the policy does not know; the grant is nil if the caller has none
+func (vm *VM) identify(token string) (*config.Grant, string) {
+	access := vm.cfg.Access
+	if access == nil {
+		return nil, "anonymous"
+	}
+	grant, ok := access.Lookup(token)
+	switch {
+	case ok:
+		return grant, grant.Name
+	case token == "":
+		return nil, "anonymous"
+	default:
+		return nil, "unknown"
+	}
+}
+
+// checks a request against the access policy and returns who made it and the
+// files it may search
+//
+// sources and files named in the request must all be allowed; when the request
+// names none, the default sources are narrowed to the allowed ones instead
+func (vm *VM) authorize(req api.GrepRequest, targets []target) (string, []target, error) {
+	access := vm.cfg.Access
+	if access == nil {
+		return "anonymous", targets, nil
+	}
+
+	grant, identity := vm.identify(req.Token)
+	deny := func(format string, args ...any) (string, []target, error) {
+		reason := fmt.Sprintf(format, args...)
+		return identity, nil, api.Errorf(api.CodeDenied, "error: access denied: %s", reason)
+	}
+
+	switch {
+	case grant == nil && req.Token == "":
+		return deny("a token is required")
+	case grant == nil:
+		return deny("unknown token")
+	}
+
+	for _, flag := range requestFlags(req.Options) {
+		if !grant.AllowsFlag(flag) {
+			return deny("flag %s is not allowed for %s", flag, identity)
+		}
+	}
+
+	named := len(req.Sources) > 0 || len(req.Files) > 0
+	var allowed []target
+	for _, t := range targets {
+		switch {
+		case grant.AllowsSource(t.source):
+			allowed = append(allowed, t)
+		case named:
+			return deny("source %q is not allowed for %s", t.source, identity)
+		}
+	}
+	if len(allowed) == 0 && !named {
+		return deny("none of the default sources are allowed for %s", identity)
+	}
+	return identity, allowed, nil
+}
+
+// reports which sources a caller may see the files of in the server's status
+// and metrics: all of them without an access policy, else those its grant allows
+func (vm *VM) visible(token string) func(source string) bool {
+	if vm.cfg.Access == nil {
+		return func(string) bool { return true }
+	}
+	grant, _ := vm.identify(token)
+	return func(source string) bool {
+		return grant != nil && grant.AllowsSource(source)
+	}
+}
+
+// the token an HTTP request presents as "Authorization: Bearer TOKEN"
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+// loads the access policy from -access into cfg, if given
+func loadAccess(cfg *config.Server, path string) error {
+	if path == "" {
+		return nil
+	}
+	access, err := config.LoadAccess(path)
+	if err != nil {
+		return err
+	}
+	cfg.Access = access
+	return nil
+}
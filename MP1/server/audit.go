@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"gb4/api"
+)
+
+// one query as seen by the server, written as a JSON line
+type auditRecord struct {
+	Time       time.Time `json:"time"`                  // when the query arrived
+	Caller     string    `json:"caller"`                // remote address of the connection
+	ClientCert string    `json:"client_cert,omitempty"` // common name of the TLS client certificate
+	Identity   string    `json:"identity"`              // grant name, "anonymous" or "unknown"
+	QueryID    string    `json:"query_id,omitempty"`
+	Query      string    `json:"query"` // the pattern
+	Flags      []string  `json:"flags,omitempty"`
+	Sources    []string  `json:"sources,omitempty"`
+	Files      []string  `json:"files,omitempty"`
+	Matches    int       `json:"matches"`
+	Bytes      int64     `json:"bytes"`   // size of the lines sent back
+	Scanned    int64     `json:"scanned"` // bytes read from the log files
+	DurationMS float64   `json:"duration_ms"`
+	Outcome    string    `json:"outcome"` // "ok" or an api.Code such as no_match
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// append-only file of audit records that is rotated once it reaches maxSize,
+// keeping path.1 (newest) to path.<keep> (oldest)
+type audit struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	closed bool // records after close are dropped
+}
+
+func openAudit(path string, maxSize int64, keep int) (*audit, error) {
+	a := &audit{path: path, maxSize: maxSize, keep: keep}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *audit) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// shifts path.N to path.N+1, dropping the oldest, and starts a new path
+func (a *audit) rotate() error {
+	a.f.Close()
+	for i := a.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	var err error
+	if a.keep > 0 {
+		err = os.Rename(a.path, a.path+".1")
+	} else {
+		err = os.Remove(a.path)
+	}
+
+	// keep recording even if the old file could not be moved
+	if openErr := a.open(); openErr != nil {
+		a.f = nil
+		return openErr
+	}
+	return err
+}
+
+// writes a record; a failed write is logged but does not fail the query
+func (a *audit) record(r auditRecord) {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(r); err != nil {
+		log.Printf("error encoding audit record: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		log.Printf("audit log closed, dropped record of query %q", r.QueryID)
+		return
+	}
+	if a.f == nil {
+		if err := a.open(); err != nil {
+			log.Printf("error opening audit log: %v", err)
+			return
+		}
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(buf.Len()) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("error rotating audit log: %v", err)
+			if a.f == nil {
+				return
+			}
+		}
+	}
+	n, err := a.f.Write(buf.Bytes())
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("error writing audit record: %v", err)
+	}
+}
+
+// flushes the log to disk and closes it, for shutdown
+func (a *audit) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Sync()
+	if closeErr := a.f.Close(); err == nil {
+		err = closeErr
+	}
+	a.f = nil
+	return err
+}
+
+// the record for a query that was turned away before it ran
+func (vm *VM) rejected(req api.GrepRequest, start time.Time, err error) auditRecord {
+	_, identity := vm.identify(req.Token)
+	status := api.StatusOf(err)
+	return auditRecord{
+		Time:       start,
+		Caller:     vm.caller,
+		ClientCert: vm.clientCert,
+		Identity:   identity,
+		QueryID:    req.QueryID,
+		Query:      req.Pattern,
+		Flags:      requestFlags(req.Options),
+		Sources:    req.Sources,
+		Files:      req.Files,
+		DurationMS: msSince(start),
+		Outcome:    string(status.Code),
+		Reason:     status.Message,
+	}
+}
+
+// the record for a query that ran, err is what stopped it early, if anything
+func (q *query) record(res api.GrepReply, err error) auditRecord {
+	status := res.Status
+	if err != nil {
+		status = api.StatusOf(err)
+	}
+	outcome := string(status.Code)
+	if status.Code == api.CodeOK {
+		outcome = "ok"
+	}
+	return auditRecord{
+		Time:       q.start,
+		Caller:     q.caller,
+		ClientCert: q.clientCert,
+		Identity:   q.identity,
+		QueryID:    q.id,
+		Query:      q.req.Pattern,
+		Flags:      requestFlags(q.req.Options),
+		Sources:    q.req.Sources,
+		Files:      q.files(),
+		Matches:    res.Total,
+		Bytes:      q.sent,
+		Scanned:    q.scanned,
+		DurationMS: msSince(q.start),
+		Outcome:    outcome,
+		Reason:     status.Message,
+	}
+}
+
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
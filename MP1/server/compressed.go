@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// gzip, zstd and bzip2, told apart by the first bytes of a file
+var compressions = []struct {
+	magic []byte
+	// checks the bytes after magic, for formats whose magic is short
+	// enough to start a line of text
+	more func(head []byte) bool
+	open func(io.Reader) (io.ReadCloser, error)
+}{
+	{[]byte{0x1f, 0x8b}, nil, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	}},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, nil, func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}},
+	// BZh is followed by the block size, '1' to '9'
+	{[]byte("BZh"), func(head []byte) bool {
+		return len(head) > 0 && head[0] >= '1' && head[0] <= '9'
+	}, func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}},
+}
+
+// returns a reader of f's text, decompressing it if it starts like a gzip,
+// zstd or bzip2 stream, and whether it did; f must be at its start
+func decompress(f *os.File) (io.ReadCloser, bool, error) {
+	head := make([]byte, 4)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	head = head[:n]
+
+	for _, c := range compressions {
+		if bytes.HasPrefix(head, c.magic) && (c.more == nil || c.more(head[len(c.magic):])) {
+			r, err := c.open(f)
+			if err != nil {
+				return nil, false, err
+			}
+			return r, true, nil
+		}
+	}
+	return io.NopCloser(f), false, nil
+}
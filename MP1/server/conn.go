@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/rpc"
+)
+
+// serves each RPC connection with its own copy of the VM that knows who is
+// on the other end, so queries can be audited with their caller
+//
+// the copy shares everything else with the VM, all of which is behind pointers
+type connHandler struct {
+	vm *VM
+}
+
+func (h connHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn := *h.vm
+	conn.caller = r.RemoteAddr
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		conn.clientCert = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("VM", &conn); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// hijacks the connection and serves it until the client hangs up
+	server.ServeHTTP(w, r)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"gb4/api"
+	"gb4/grep"
+)
+
+const (
+	// how often followed files are checked for new lines
+	followPoll = 250 * time.Millisecond
+	// a line not terminated after this many bytes is matched as it is
+	maxPartial = 1024 * 1024
+)
+
+// options that need lines a subscription never sees: the past, or the end
+func checkFollow(req api.GrepRequest) error {
+	switch opts := req.Options; {
+	case !req.Since.IsZero() || !req.Until.IsZero():
+		return &api.ArgError{Arg: "--since/--until", Reason: "cannot be followed, only new lines are"}
+	case opts.Count:
+		return &api.ArgError{Arg: "-c", Reason: "cannot be followed, a count needs the end of the log"}
+	case opts.Before > 0 || opts.After > 0:
+		return &api.ArgError{Arg: "-A/-B/-C", Reason: "context lines cannot be followed"}
+	}
+	return nil
+}
+
+// only live logs get new lines, their rotated copies are left out
+func liveTargets(targets []target) []target {
+	live := targets[:0]
+	for _, t := range targets {
+		if t.newer == "" {
+			live = append(live, t)
+		}
+	}
+	return live
+}
+
+// registers a subscription: it has no deadline and holds no query slot, since
+// it spends most of its time waiting, but only Limits.Follows may be open at
+// once; the returned func must be called once it is over
+func (vm *VM) subscribe() (context.Context, func(), error) {
+	if vm.running.isClosed() {
+		return nil, nil, api.Errorf(api.CodeOverloaded, "error: server is shutting down")
+	}
+	select {
+	case vm.follows <- struct{}{}:
+	default:
+		return nil, nil, api.Errorf(api.CodeOverloaded, "error: server busy, %d subscriptions open", cap(vm.follows))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return ctx, func() {
+		cancel()
+		<-vm.follows
+	}, nil
+}
+
+// a followed file: where reading left off, and the start of a line whose
+// end has not been written yet
+type tail struct {
+	target
+	f       *os.File // nil until the file exists
+	offset  int64    // bytes of f read so far
+	line    int      // lines of f read so far, from its start only with -n
+	partial []byte
+	skip    bool // compressed, nothing is ever appended to it
+}
+
+// starts following a file at its current end, so only lines written from now
+// on are matched; with -n the lines before it are counted to number the rest
+func openTail(ctx context.Context, t target, numbers bool) (*tail, error) {
+	tl := &tail{target: t}
+	f, err := os.Open(t.file)
+	if errors.Is(err, os.ErrNotExist) {
+		// picked up from its first line once it is created
+		return tl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	text, compressed, err := decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	text.Close()
+	if compressed {
+		f.Close()
+		log.Printf("%s: compressed, not followed", t.file)
+		tl.skip = true
+		return tl, nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	tl.f, tl.offset = f, info.Size()
+	if numbers {
+		if tl.line, err = countLines(ctx, f, tl.offset); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return tl, nil
+}
+
+// reads whatever was appended since the last poll and passes each complete
+// line to emit; a file truncated in place is read again from its start, and
+// once the path names a new file, as after a rotation, the old one is read
+// to its end and the new one followed from its first line
+// reading stops with errScanLimit after budget bytes, a negative budget has no limit
+func (tl *tail) poll(budget int64, emit func(grep.Line) error) (int64, error) {
+	if tl.skip {
+		return 0, nil
+	}
+	if tl.f == nil {
+		f, err := os.Open(tl.file)
+		if err != nil {
+			// not created yet
+			return 0, nil
+		}
+		tl.f = f
+	}
+
+	var scanned int64
+	if current, err := os.Stat(tl.file); err == nil {
+		if info, err := tl.f.Stat(); err == nil && !os.SameFile(current, info) {
+			n, err := tl.read(budget, emit)
+			scanned += n
+			if err != nil {
+				return scanned, err
+			}
+			if err := tl.flush(emit); err != nil {
+				return scanned, err
+			}
+			log.Printf("%s: rotated, following the new file", tl.file)
+			tl.reset()
+			tl.f.Close()
+			if tl.f, err = os.Open(tl.file); err != nil {
+				tl.f = nil
+				return scanned, nil
+			}
+		}
+	}
+
+	info, err := tl.f.Stat()
+	if err != nil {
+		return scanned, err
+	}
+	if info.Size() < tl.offset {
+		log.Printf("%s: truncated, following it from the start", tl.file)
+		tl.reset()
+	}
+	if budget >= 0 {
+		budget = max(budget-scanned, 0)
+	}
+	n, err := tl.read(budget, emit)
+	return scanned + n, err
+}
+
+// reads f from offset to its current end, or until budget bytes are read
+func (tl *tail) read(budget int64, emit func(grep.Line) error) (int64, error) {
+	buf := make([]byte, 64*1024)
+	var scanned int64
+	for {
+		if budget >= 0 && scanned >= budget {
+			return scanned, errScanLimit
+		}
+		chunk := buf
+		if budget >= 0 && budget-scanned < int64(len(chunk)) {
+			chunk = chunk[:budget-scanned]
+		}
+		n, err := tl.f.ReadAt(chunk, tl.offset)
+		tl.offset += int64(n)
+		scanned += int64(n)
+		tl.partial = append(tl.partial, chunk[:n]...)
+
+		for {
+			i := bytes.IndexByte(tl.partial, '\n')
+			if i < 0 {
+				break
+			}
+			if err := tl.emitLine(tl.partial[:i], emit); err != nil {
+				return scanned, err
+			}
+			tl.partial = tl.partial[i+1:]
+		}
+		if len(tl.partial) > maxPartial {
+			if err := tl.flush(emit); err != nil {
+				return scanned, err
+			}
+		}
+
+		if err == io.EOF || n == 0 {
+			// keep the partial line's bytes, not the larger buffer behind them
+			tl.partial = append([]byte(nil), tl.partial...)
+			return scanned, nil
+		}
+		if err != nil {
+			return scanned, err
+		}
+	}
+}
+
+// matches the unterminated line as it is, for the end of a rotated file or
+// a line too long to wait for
+func (tl *tail) flush(emit func(grep.Line) error) error {
+	if len(tl.partial) == 0 {
+		return nil
+	}
+	err := tl.emitLine(tl.partial, emit)
+	tl.partial = nil
+	return err
+}
+
+func (tl *tail) emitLine(raw []byte, emit func(grep.Line) error) error {
+	start := tl.offset - int64(len(tl.partial))
+	tl.line++
+	return emit(grep.Line{
+		Number: tl.line,
+		Offset: start,
+		Text:   string(bytes.TrimSuffix(raw, []byte("\r"))),
+	})
+}
+
+// starts over at the beginning of the file
+func (tl *tail) reset() {
+	tl.offset, tl.line, tl.partial = 0, 0, nil
+}
+
+func (tl *tail) close() {
+	if tl.f != nil {
+		tl.f.Close()
+	}
+}
+
+// follows the query's files, passing each new matching line to emit as it
+// is written, until the query is cancelled, -m lines have matched or it
+// reaches one of the server's limits
+// returns the summary of what was seen, like query.run
+func (q *query) follow(emit func(api.Match) error) (api.GrepReply, error) {
+	start := time.Now()
+	res := api.GrepReply{
+		Files:  q.files(),
+		Counts: make(map[string]int, len(q.targets)),
+	}
+	res.Hostname, _ = os.Hostname()
+	opts := q.req.Options
+	if opts.Limited() && opts.MaxCount == 0 {
+		// -m 0 selects nothing, there is nothing to wait for
+		return res, nil
+	}
+	maxLines := q.req.MaxLines
+	if limit := q.limits.Lines; limit > 0 && (maxLines == 0 || limit < maxLines) {
+		maxLines = limit
+	}
+	maxBytes := int64(q.limits.ReturnMB) << 20
+
+	var tails []*tail
+	defer func() {
+		for _, tl := range tails {
+			tl.close()
+		}
+	}()
+	for _, t := range q.targets {
+		tl, err := openTail(q.ctx, t, opts.LineNumbers)
+		if err != nil {
+			if q.ctx.Err() != nil {
+				return res, q.stopped()
+			}
+			failure := "grep: " + t.file + ": " + err.Error()
+			log.Println(failure)
+			res.Errors = append(res.Errors, failure)
+			continue
+		}
+		tails = append(tails, tl)
+	}
+	if len(tails) == 0 && len(res.Errors) > 0 {
+		return res, api.Errorf(api.CodeSourceMissing, "%s", res.Errors[0])
+	}
+	log.Printf("follow %q: following %d files", q.req.Pattern, len(tails))
+
+	ticker := time.NewTicker(followPoll)
+	defer ticker.Stop()
+	for {
+		for _, tl := range tails {
+			budget := int64(-1)
+			if q.limits.ScanMB > 0 {
+				budget = max(int64(q.limits.ScanMB)<<20-q.scanned, 0)
+			}
+			n, err := tl.poll(budget, func(line grep.Line) error {
+				if !q.matcher.Match([]byte(line.Text)) {
+					return nil
+				}
+				if (maxLines > 0 && res.Total >= maxLines) || (maxBytes > 0 && q.sent+int64(len(line.Text)) > maxBytes) {
+					// nothing more could ever be sent
+					res.Truncated = true
+					return errFollowDone
+				}
+				if !opts.LineNumbers {
+					line.Number = 0
+				}
+				res.Total++
+				res.Counts[tl.file]++
+				if err := emit(api.Match{
+					Source: tl.source,
+					File:   tl.file,
+					Line:   line.Number,
+					Offset: line.Offset,
+					Text:   line.Text,
+				}); err != nil {
+					return err
+				}
+				q.sent += int64(len(line.Text))
+				if opts.Limited() && res.Total >= opts.MaxCount {
+					return errFollowDone
+				}
+				return nil
+			})
+			q.scanned += n
+
+			res.Elapsed = time.Since(start)
+			if errors.Is(err, errFollowDone) {
+				if res.Truncated {
+					log.Printf("query %s reached the line or byte limit", q.id)
+				}
+				return res, nil
+			}
+			if q.ctx.Err() != nil {
+				return res, q.stopped()
+			}
+			if errors.Is(err, errScanLimit) {
+				log.Printf("query %s hit the scan limit", q.id)
+				return res, api.Errorf(api.CodeLimit, "error: query %s stopped after reading %dMB, the server's limit", q.id, q.limits.ScanMB)
+			}
+			if err != nil {
+				// tried again on the next poll
+				log.Printf("follow: %s: %v", tl.file, err)
+			}
+		}
+
+		select {
+		case <-q.ctx.Done():
+			res.Elapsed = time.Since(start)
+			return res, q.stopped()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ends a subscription once -m lines have matched or no more may be sent
+var errFollowDone = errors.New("subscription done")
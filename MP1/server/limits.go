@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"gb4/api"
+)
+
+// bounds the queries scanning at once; up to queue more wait for a slot in
+// arrival order, any beyond that are refused as overloaded
+type admission struct {
+	slots chan struct{}
+	queue int
+
+	mu      sync.Mutex
+	waiting int
+}
+
+func newAdmission(slots, queue int) *admission {
+	return &admission{slots: make(chan struct{}, slots), queue: queue}
+}
+
+// waits for a slot until ctx ends; the returned func gives the slot back
+func (a *admission) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-a.slots }
+	select {
+	case a.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	a.mu.Lock()
+	if a.waiting >= a.queue {
+		a.mu.Unlock()
+		return nil, api.Errorf(api.CodeOverloaded, "error: server busy, %d queries running and %d waiting", cap(a.slots), a.queue)
+	}
+	a.waiting++
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.waiting--
+		a.mu.Unlock()
+	}()
+
+	select {
+	case a.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, api.Errorf(api.CodeTimeout, "error: query timed out waiting for a slot")
+		}
+		return nil, api.Errorf(api.CodeCancelled, "error: query cancelled waiting for a slot")
+	}
+}
+
+// the number of queries holding a slot and waiting for one
+func (a *admission) load() (active, waiting int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.slots), a.waiting
+}
+
+// returned by a budgetReader once its budget is spent
+var errScanLimit = errors.New("scan limit reached")
+
+// reads from r until n bytes have been read, then fails with errScanLimit
+type budgetReader struct {
+	r io.Reader
+	n int64
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		return 0, errScanLimit
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.r.Read(p)
+	b.n -= int64(n)
+	return n, err
+}
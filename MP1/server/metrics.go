@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gb4/api"
+)
+
+// upper bounds in seconds of the query latency histogram buckets
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 600}
+
+// counters for every query the server has answered, exposed on /metrics in
+// the Prometheus text format
+type metrics struct {
+	mu       sync.Mutex
+	outcomes map[string]int64 // queries by audit outcome
+	buckets  []int64          // queries per latency bucket, not cumulative
+	seconds  float64          // total latency
+	scanned  int64
+	returned int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		outcomes: make(map[string]int64),
+		buckets:  make([]int64, len(latencyBuckets)+1),
+	}
+}
+
+// counts a finished or rejected query
+func (m *metrics) observe(r auditRecord) {
+	seconds := r.DurationMS / 1000
+	bucket := sort.SearchFloat64s(latencyBuckets, seconds)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outcomes[r.Outcome]++
+	m.buckets[bucket]++
+	m.seconds += seconds
+	m.scanned += r.Scanned
+	m.returned += r.Bytes
+}
+
+// writes a finished or rejected query to the audit log and the metrics
+func (vm *VM) report(r auditRecord) {
+	vm.audit.record(r)
+	vm.metrics.observe(r)
+}
+
+// serves /metrics on the RPC listener
+func (vm *VM) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var out bytes.Buffer
+	vm.metrics.write(&out)
+	active, waiting := vm.admit.load()
+	writeGauge(&out, "querier_queries_in_flight", "Queries running right now, streaming ones included.",
+		sample{value: float64(active)})
+	writeGauge(&out, "querier_queries_queued", "Queries waiting for a slot to run in.",
+		sample{value: float64(waiting)})
+	writeGauge(&out, "querier_follows_open", "Subscriptions from VM.Follow open right now.",
+		sample{value: float64(len(vm.follows))})
+	writeGauge(&out, "querier_source_file_size_bytes", "Size of each file of each log source.",
+		vm.sourceSizes(vm.visible(bearerToken(r)))...)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+func (m *metrics) write(out *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	outcomes := make([]string, 0, len(m.outcomes))
+	for outcome := range m.outcomes {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+
+	var total int64
+	var queries, failures []sample
+	for _, outcome := range outcomes {
+		n := m.outcomes[outcome]
+		total += n
+		queries = append(queries, sample{labels: []string{"outcome", outcome}, value: float64(n)})
+		// no match is an answer, not an error
+		if outcome != "ok" && outcome != string(api.CodeNoMatch) {
+			failures = append(failures, sample{labels: []string{"code", outcome}, value: float64(n)})
+		}
+	}
+	writeCounter(out, "querier_queries_total", "Queries answered, by outcome.", queries...)
+	writeCounter(out, "querier_query_errors_total", "Queries that failed, by error code.", failures...)
+
+	name := "querier_query_duration_seconds"
+	fmt.Fprintf(out, "# HELP %s Time from a query arriving to its last line.\n", name)
+	fmt.Fprintf(out, "# TYPE %s histogram\n", name)
+	var cumulative int64
+	for i, le := range latencyBuckets {
+		cumulative += m.buckets[i]
+		fmt.Fprintf(out, "%s_bucket{le=%q} %d\n", name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(out, "%s_bucket{le=\"+Inf\"} %d\n", name, total)
+	fmt.Fprintf(out, "%s_sum %s\n", name, formatFloat(m.seconds))
+	fmt.Fprintf(out, "%s_count %d\n", name, total)
+
+	writeCounter(out, "querier_scanned_bytes_total", "Bytes read from log files.", sample{value: float64(m.scanned)})
+	writeCounter(out, "querier_returned_bytes_total", "Bytes of matching lines sent to clients.", sample{value: float64(m.returned)})
+}
+
+// the current size of every file of every visible source, files that cannot
+// be read are left out
+func (vm *VM) sourceSizes(visible func(source string) bool) []sample {
+	var sizes []sample
+	for _, src := range vm.cfg.Sources {
+		if !visible(src.Name) {
+			continue
+		}
+		files, err := src.Files()
+		if err != nil {
+			log.Printf("metrics: %v", err)
+			continue
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			sizes = append(sizes, sample{
+				labels: []string{"source", src.Name, "file", file},
+				value:  float64(info.Size()),
+			})
+		}
+	}
+	return sizes
+}
+
+// one value of a metric with its label names and values, in pairs
+type sample struct {
+	labels []string
+	value  float64
+}
+
+func writeCounter(out *bytes.Buffer, name, help string, samples ...sample) {
+	writeMetric(out, name, "counter", help, samples)
+}
+
+func writeGauge(out *bytes.Buffer, name, help string, samples ...sample) {
+	writeMetric(out, name, "gauge", help, samples)
+}
+
+func writeMetric(out *bytes.Buffer, name, kind, help string, samples []sample) {
+	fmt.Fprintf(out, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(out, "# TYPE %s %s\n", name, kind)
+	for _, s := range samples {
+		out.WriteString(name)
+		if len(s.labels) > 0 {
+			pairs := make([]string, 0, len(s.labels)/2)
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				pairs = append(pairs, s.labels[i]+`="`+labelEscaper.Replace(s.labels[i+1])+`"`)
+			}
+			out.WriteString("{" + strings.Join(pairs, ",") + "}")
+		}
+		out.WriteString(" " + formatFloat(s.value) + "\n")
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
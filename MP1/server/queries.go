@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gb4/api"
+)
+
+const (
+	// deadline for queries that do not carry one
+	defaultTimeout = 2 * time.Minute
+	// no query may run longer than this, whatever it asks for
+	maxTimeout = 10 * time.Minute
+)
+
+// who started a query; only they may read, close or cancel it
+//
+// VM.Next, VM.Close and VM.Cancel carry no token, so the connection stands in
+// for it: its remote address and port, and its client certificate under TLS
+type owner struct {
+	identity   string // see authorize, for the log
+	caller     string
+	clientCert string
+}
+
+// the owner of the queries started on vm's connection
+func (vm *VM) owner(identity string) owner {
+	return owner{identity: identity, caller: vm.caller, clientCert: vm.clientCert}
+}
+
+// reports whether o and other are the same connection
+func (o owner) is(other owner) bool {
+	return o.caller == other.caller && o.clientCert == other.clientCert
+}
+
+// queries currently running on this server, so they can be cancelled by id
+type running struct {
+	mu      sync.Mutex
+	queries map[string]runningQuery
+	closed  bool // the server is shutting down, no new queries start
+}
+
+type runningQuery struct {
+	cancel context.CancelFunc
+	owner  owner
+}
+
+func newRunning() *running {
+	return &running{queries: make(map[string]runningQuery)}
+}
+
+// registers a query and returns a context that ends at its deadline or when
+// it is cancelled; the returned func must be called once the query is over
+func (r *running) start(id string, timeout time.Duration, by owner) (context.Context, func(), error) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, nil, api.Errorf(api.CodeOverloaded, "error: server is shutting down")
+	}
+	if _, ok := r.queries[id]; ok {
+		return nil, nil, api.Errorf(api.CodeInvalidQuery, "error: query %s is already running", id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	r.queries[id] = runningQuery{cancel: cancel, owner: by}
+
+	done := func() {
+		cancel()
+		r.mu.Lock()
+		delete(r.queries, id)
+		r.mu.Unlock()
+	}
+	return ctx, done, nil
+}
+
+// the number of queries running right now
+func (r *running) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queries)
+}
+
+// registers a query as running and waits for a slot to run it in; the
+// returned func must be called once the query is over
+func (vm *VM) register(id string, timeout time.Duration, by owner) (context.Context, func(), error) {
+	ctx, finish, err := vm.running.start(id, timeout, by)
+	if err != nil {
+		return nil, nil, err
+	}
+	// registered first so a query can be cancelled while it waits
+	release, err := vm.admit.acquire(ctx)
+	if err != nil {
+		finish()
+		return nil, nil, err
+	}
+	return ctx, func() {
+		release()
+		finish()
+	}, nil
+}
+
+// refuses every query started from now on
+func (r *running) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+}
+
+func (r *running) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// stops every running query
+func (r *running) cancelAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, q := range r.queries {
+		q.cancel()
+	}
+}
+
+// stops a running query of by's, reports whether it was found
+func (r *running) cancel(id string, by owner) bool {
+	r.mu.Lock()
+	q, ok := r.queries[id]
+	r.mu.Unlock()
+
+	if !ok || !q.owner.is(by) {
+		return false
+	}
+	q.cancel()
+	return true
+}
+
+// this is an RPC function that can be called remotely
+//
+// stops the query with the given id, whether it is a VM.Search call still
+// scanning, an open streaming query or a subscription; reply is false if
+// nothing was running; only the connection that started a query can stop it
+// a stopped stream stays open so its last VM.Next can report the cancellation
+func (vm *VM) Cancel(id string, reply *bool) error {
+	by := vm.owner("")
+	found := vm.running.cancel(id, by)
+	if vm.streams.stop(id, by) {
+		found = true
+	}
+	*reply = found
+	return nil
+}
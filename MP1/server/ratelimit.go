@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"gb4/api"
+	"gb4/config"
+)
+
+// buckets idle this long are full again and are forgotten
+const bucketIdle = 10 * time.Minute
+
+// a token bucket per caller
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time // time.Now but in tests
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	l := &rateLimiter{buckets: make(map[string]*bucket), now: time.Now}
+	go l.reap()
+	return l
+}
+
+// takes a token from key's bucket, or reports how long until one is there
+func (l *rateLimiter) take(key string, rate config.Rate) (time.Duration, bool) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(rate.Burst), b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - b.tokens) / rate.PerSecond * float64(time.Second))
+	return wait.Round(time.Millisecond), false
+}
+
+// forgets callers that have not sent a query in a while
+func (l *rateLimiter) reap() {
+	for range time.Tick(bucketIdle / 2) {
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if time.Since(b.last) > bucketIdle {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// checks a request against the caller's rate: a grant's own rate or the
+// server's, counted per grant for callers with a token and per remote host
+// for everyone else
+func (vm *VM) limitRate(req api.GrepRequest) error {
+	grant, identity := vm.identify(req.Token)
+	rate := vm.cfg.Rate
+	if grant != nil && grant.Rate != nil {
+		rate = grant.Rate
+	}
+	if rate == nil {
+		return nil
+	}
+
+	key := "grant " + identity
+	if grant == nil || req.Token == "" {
+		host, _, err := net.SplitHostPort(vm.caller)
+		if err != nil {
+			host = vm.caller
+		}
+		key = "host " + host
+	}
+
+	wait, ok := vm.rates.take(key, *rate)
+	if ok {
+		return nil
+	}
+	return &api.Error{
+		Code:       api.CodeRateLimited,
+		Message:    fmt.Sprintf("error: rate limit exceeded for %s, retry after %s", key, wait),
+		RetryAfter: wait,
+	}
+}
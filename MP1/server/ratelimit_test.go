@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"gb4/api"
+	"gb4/config"
+)
+
+// a limiter whose clock only moves when the test says so
+func testLimiter() (*rateLimiter, *time.Time) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	l := &rateLimiter{buckets: make(map[string]*bucket), now: func() time.Time { return now }}
+	return l, &now
+}
+
+func TestTake(t *testing.T) {
+	rate := config.Rate{PerSecond: 2, Burst: 3}
+	tests := []struct {
+		name    string
+		advance time.Duration // before taking
+		key     string
+		ok      bool
+		wait    time.Duration
+	}{
+		{"burst 1", 0, "a", true, 0},
+		{"burst 2", 0, "a", true, 0},
+		{"burst 3", 0, "a", true, 0},
+		{"empty", 0, "a", false, 500 * time.Millisecond},
+		{"still empty", 0, "a", false, 500 * time.Millisecond},
+		{"other key", 0, "b", true, 0},
+		{"part refilled", 200 * time.Millisecond, "a", false, 300 * time.Millisecond},
+		{"refilled one", 300 * time.Millisecond, "a", true, 0},
+		{"empty again", 0, "a", false, 500 * time.Millisecond},
+		{"refill stops at burst", time.Hour, "a", true, 0},
+		{"burst 2 after refill", 0, "a", true, 0},
+		{"burst 3 after refill", 0, "a", true, 0},
+		{"empty after refill", 0, "a", false, 500 * time.Millisecond},
+	}
+	l, now := testLimiter()
+	for _, tt := range tests {
+		*now = now.Add(tt.advance)
+		wait, ok := l.take(tt.key, rate)
+		if ok != tt.ok || wait != tt.wait {
+			t.Errorf("%s: take = %v, %v; want %v, %v", tt.name, wait, ok, tt.wait, tt.ok)
+		}
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	access := &config.Access{Grants: []config.Grant{
+		{Name: "ops", TokenSHA256: tokenHash("ops"), Sources: []string{"*"}},
+		{Name: "report", TokenSHA256: tokenHash("report"), Sources: []string{"*"},
+			Rate: &config.Rate{PerSecond: 1, Burst: 2}},
+	}}
+
+	tests := []struct {
+		caller string
+		token  string
+		ok     bool
+	}{
+		{"10.0.0.1:5000", "", true},
+		// the same host on another connection shares its bucket
+		{"10.0.0.1:5001", "", false},
+		{"10.0.0.2:5000", "", true},
+		// unknown tokens count against the host
+		{"10.0.0.3:5000", "nope", true},
+		{"10.0.0.3:5001", "", false},
+		// a grant is counted wherever it comes from
+		{"10.0.0.4:5000", "ops", true},
+		{"10.0.0.5:5000", "ops", false},
+		// with a rate of its own
+		{"10.0.0.4:5000", "report", true},
+		{"10.0.0.5:5000", "report", true},
+		{"10.0.0.6:5000", "report", false},
+	}
+	rates, _ := testLimiter()
+	cfg := &config.Server{Access: access, Rate: &config.Rate{PerSecond: 1, Burst: 1}}
+	for _, tt := range tests {
+		vm := &VM{cfg: cfg, rates: rates, caller: tt.caller}
+		err := vm.limitRate(api.GrepRequest{Token: tt.token})
+		var apiErr *api.Error
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s with %q: %v", tt.caller, tt.token, err)
+		case !tt.ok && !errors.As(err, &apiErr):
+			t.Errorf("%s with %q: %v, want an error", tt.caller, tt.token, err)
+		case !tt.ok && (apiErr.Code != api.CodeRateLimited || apiErr.RetryAfter != time.Second):
+			t.Errorf("%s with %q: %s retry after %s, want rate_limited after 1s", tt.caller, tt.token, apiErr.Code, apiErr.RetryAfter)
+		}
+	}
+}
+
+// the token_sha256 of a grant for token
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,154 +1,660 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/rpc"
-	"os/exec"
 	"log"
 	"strconv"
 	"strings"
 	"os"
-	"mvdan.cc/sh/v3/shell"
+	"runtime"
+	"time"
+	"flag"
+
+	"gb4/api"
+	"gb4/config"
+	"gb4/grep"
 )
 
 type VM struct{
 	listener net.Listener
+	cfg      *config.Server
+	streams  *streams
+	running  *running
+	audit    *audit
+	metrics  *metrics
+	started  time.Time
+	admit    *admission
+	follows  chan struct{} // a token per open subscription, see subscribe
+	rates    *rateLimiter
+
+	// the other end of the connection, set on each connection's copy, see connHandler
+	caller     string
+	clientCert string
 }
 
-// checks input for malicious commands
-func Validate(tokens []string) error {
-	lower := strings.ToLower(tokens[0])
+// returns the log file served by a course VM, based on its hostname
+// only used when the server is started without a config or -source flags
+func defaultLog() string {
+	hostname, _ := os.Hostname()
 
-	// early return for trivial request
-	if lower == "grep" && (len(tokens) == 1) {
-		return nil
+	switch {
+		case strings.Contains(hostname, "b401"): 
+			return "../log/vm1.log"
+		case strings.Contains(hostname, "b402"):
+			return "../log/vm2.log"
+		case strings.Contains(hostname, "b403"): 
+			return "../log/vm3.log"
+		case strings.Contains(hostname, "b404"): 
+			return "../log/vm4.log"
+		case strings.Contains(hostname, "b405"): 
+			return "../log/vm5.log"
+		case strings.Contains(hostname, "b406"): 
+			return "../log/vm6.log"
+		case strings.Contains(hostname, "b407"): 
+			return "../log/vm7.log"
+		case strings.Contains(hostname, "b408"): 
+			return "../log/vm8.log"
+		case strings.Contains(hostname, "b409"): 
+			return "../log/vm9.log"
+		case strings.Contains(hostname, "b410"):
+			return "../log/vm10.log"
+		default:
+			return "../log/log.txt"
 	}
+}
 
-	// validate user actually made a grep request
-	if lower != "grep" {
-		errMsg := fmt.Sprintf("error command not found: %s", lower)
-		return errors.New(errMsg)
+// this is an RPC function that can be called remotely
+//
+// compatibility shim for clients that send a raw command string
+// turns a cmd e.g. grep [flags] "pattern" filename into a request, runs it
+// and returns grep formatted output followed by a MATCHES: N line
+func (vm *VM) Grep(str string, reply *string) error {
+	// flags are checked against the allow-list, files against the sources
+	req, err := api.ParseCommand(str)
+	if err != nil {
+		// the raw command is left out of the audit log as well
+		vm.report(vm.rejected(api.GrepRequest{}, time.Now(), err))
+		return err
 	}
+	// the command may carry a token, so only the parsed query is logged
+	log.Printf("grep: %q sources %v files %v", req.Pattern, req.Sources, req.Files)
 
-	return nil
+	// the raw interface always searches the VM's default sources as well
+	if len(req.Sources) == 0 {
+		req.Sources = vm.cfg.DefaultSources()
+	}
+
+	var res api.GrepReply
+	vm.Search(req, &res)
+	if err := res.Err(); err != nil {
+		return err
+	}
 
+	// no match is an answer, not a failure: the reply is just MATCHES: 0
+	output := res.Text(req.Options)
+	for _, failure := range res.Errors {
+		output = output + "\n" + failure
+	}
+	*reply = strings.TrimPrefix(output+"\nMATCHES: "+strconv.Itoa(res.Total), "\n")
+	return nil
 }
 
 // this is an RPC function that can be called remotely
 //
-// turns a cmd e.g. grep [flags] "pattern" filename into a splice
-// calls exec on the splice and returns either the output or error
-func (vm *VM) Grep(str string, reply *string) error {
-	tokens, err := shell.Fields(str, nil)
+// runs a typed grep request over the requested sources and files
+// (or the default sources) and returns every line in a single reply
+// failures are reported in the reply's Status with a code, never as an RPC error
+func (vm *VM) Search(req api.GrepRequest, reply *api.GrepReply) error {
+	q, err := vm.prepare(req, false)
+	if err != nil {
+		*reply = api.GrepReply{Status: api.StatusOf(err)}
+		return nil
+	}
+	defer q.finish()
 
+	var matches []api.Match
+	res, err := q.run(func(m api.Match) error {
+		matches = append(matches, m)
+		return nil
+	})
+	vm.report(q.record(res, err))
 	if err != nil {
-		return err
+		// a timeout or cancel still returns what was found until then
+		res.Status = api.StatusOf(err)
 	}
 
-	log.Print(tokens)
+	res.Matches = matches
+	*reply = res
+	return nil
+}
+
+// a file to search and the source it belongs to
+type target struct {
+	source string
+	file   string
+	// for rotated logs, the next newer file of the log's history, empty for
+	// the live log; see window.prune
+	newer   string
+	rotated bool // part of a rotated log's history, the live log included
+}
+
+// a compiled request together with the files it will search
+type query struct {
+	id       string
+	identity string // who asked, see authorize
+	req      api.GrepRequest
+	matcher  *grep.Matcher
+	targets  []target
+	window   *window // nil unless the query has --since/--until
+	limits   config.Limits
+
+	// for the audit log
+	caller     string
+	clientCert string
+	start      time.Time
+	sent       int64 // bytes of lines emitted so far
+	scanned    int64 // bytes read from the files so far
 
-	err = Validate(tokens)
+	// ends at the query's deadline or when it is cancelled
+	ctx    context.Context
+	finish func()
+}
 
+// compiles the pattern, resolves the files for a request and registers it
+// as running, or as a subscription if follow is set; the caller must call
+// q.finish once the query is over
+// a request that cannot run is reported here, one that runs is reported by
+// its caller once it is over
+func (vm *VM) prepare(req api.GrepRequest, follow bool) (*query, error) {
+	start := time.Now()
+	q, err := vm.compile(req, follow)
 	if err != nil {
-		return err
+		vm.report(vm.rejected(req, start, err))
+		return nil, err
 	}
+	q.start = start
+	return q, nil
+}
 
-	hostname, err := os.Hostname()
-	
-	switch {
-		case strings.Contains(hostname, "b401"): 
-			tokens = append(tokens, "../log/vm1.log")
-		case strings.Contains(hostname, "b402"):
-			tokens = append(tokens, "../log/vm2.log")
-		case strings.Contains(hostname, "b403"): 
-			tokens = append(tokens, "../log/vm3.log")
-		case strings.Contains(hostname, "b404"): 
-			tokens = append(tokens, "../log/vm4.log")
-		case strings.Contains(hostname, "b405"): 
-			tokens = append(tokens, "../log/vm5.log")
-		case strings.Contains(hostname, "b406"): 
-			tokens = append(tokens, "../log/vm6.log")
-		case strings.Contains(hostname, "b407"): 
-			tokens = append(tokens, "../log/vm7.log")
-		case strings.Contains(hostname, "b408"): 
-			tokens = append(tokens, "../log/vm8.log")
-		case strings.Contains(hostname, "b409"): 
-			tokens = append(tokens, "../log/vm9.log")
-		case strings.Contains(hostname, "b410"):
-			tokens = append(tokens, "../log/vm10.log")
-		default:
-			tokens = append(tokens, "../log/log.txt")
+func (vm *VM) compile(req api.GrepRequest, follow bool) (*query, error) {
+	// before anything else, so a caller over its rate costs no more work
+	// whatever it sends
+	if err := vm.limitRate(req); err != nil {
+		return nil, err
+	}
+	if err := req.Check(); err != nil {
+		return nil, err
+	}
+	if follow {
+		if err := checkFollow(req); err != nil {
+			return nil, err
+		}
+	}
+
+	matcher, err := grep.Compile(req.Pattern, req.Options)
+	if err != nil {
+		return nil, &api.Error{Code: api.CodeInvalidQuery, Message: err.Error()}
 	}
-	
-	cmd := exec.Command(tokens[0], tokens[1:]...)
 
-	// CombinedOutputs merges both the stdout and stderr, as well as an error code
-	out, err := cmd.CombinedOutput()
-	log.Println(string(out))
+	targets, err := vm.resolve(req)
+	if err != nil {
+		return nil, err
+	}
 
+	identity, targets, err := vm.authorize(req, targets)
 	if err != nil {
-		log.Println(err.Error())
-
-		// exit status 1 -> no match found
-		// exit status 2 -> invalid input
-		// else -> something else went wrong
-		
-		if err.Error() == "exit status 1" {
-			err = errors.New("error: no match found")
-			return err
-		}  
+		return nil, err
+	}
+
+	window, err := newWindow(req)
+	if err != nil {
+		return nil, err
+	}
+	if window != nil {
+		targets = window.prune(targets)
+	}
+	if follow {
+		targets = liveTargets(targets)
+	}
+
+	id := req.QueryID
+	if id == "" {
+		id = api.NewQueryID()
+	}
+	if vm.streams.has(id) {
+		// finished scanning, but its lines have not all been read
+		return nil, api.Errorf(api.CodeInvalidQuery, "error: query %s is already running", id)
+	}
+	var ctx context.Context
+	var finish func()
+	if follow {
+		ctx, finish, err = vm.subscribe()
+	} else {
+		ctx, finish, err = vm.register(id, req.Timeout, vm.owner(identity))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &query{
+		id:         id,
+		identity:   identity,
+		req:        req,
+		matcher:    matcher,
+		targets:    targets,
+		window:     window,
+		limits:     vm.cfg.Limits,
+		caller:     vm.caller,
+		clientCert: vm.clientCert,
+		ctx:        ctx,
+		finish:     finish,
+	}, nil
+}
+
+// turns the sources and files named in a request into the files to search
+// a request naming neither searches the default sources
+func (vm *VM) resolve(req api.GrepRequest) ([]target, error) {
+	names := req.Sources
+	if len(names) == 0 && len(req.Files) == 0 {
+		names = vm.cfg.DefaultSources()
+	}
+
+	var targets []target
+	seen := make(map[string]bool)
+	for _, name := range names {
+		src, ok := vm.cfg.Source(name)
+		if !ok {
+			return nil, api.Errorf(api.CodeSourceMissing, "error: unknown source %q", name)
+		}
+		histories, err := src.Histories()
+		if err != nil {
+			return nil, err
+		}
+		for _, history := range histories {
+			for i, file := range history {
+				if seen[file] {
+					continue
+				}
+				seen[file] = true
+				t := target{source: name, file: file, rotated: src.Rotate != ""}
+				if i+1 < len(history) {
+					t.newer = history[i+1]
+				}
+				targets = append(targets, t)
+			}
+		}
+	}
 
-		if err.Error() != "exit status 2" {
-			err = errors.New("error: catastophic failure")
+	// explicit files must belong to a source, nothing else on the VM can be read
+	for _, file := range req.Files {
+		src, path, ok, err := vm.cfg.Owner(file)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, &api.ArgError{Arg: file, Reason: "not a file of any configured log source"}
+		}
+		if !seen[path] {
+			seen[path] = true
+			targets = append(targets, target{source: src.Name, file: path})
+		}
+	}
+	return targets, nil
+}
+
+// returns the files the query will search, in order
+func (q *query) files() []string {
+	files := make([]string, len(q.targets))
+	for i, t := range q.targets {
+		files[i] = t.file
+	}
+	return files
+}
+
+// scans every file once, passing each line to emit as it is found
+// returns the summary of the run, i.e. a reply without the lines
+// lines past MaxLines or the server's limits are counted but not emitted,
+// -c emits no lines at all
+// the run stops when the query's deadline passes, it is cancelled or it has
+// read as much as the server allows
+func (q *query) run(emit func(api.Match) error) (api.GrepReply, error) {
+	start := time.Now()
+	res := api.GrepReply{
+		Files:  q.files(),
+		Counts: make(map[string]int, len(q.targets)),
+	}
+	res.Hostname, _ = os.Hostname()
+
+	countOnly := q.req.Options.Count
+	emitted := 0
+	maxLines := q.req.MaxLines
+	if limit := q.limits.Lines; limit > 0 && (maxLines == 0 || limit < maxLines) {
+		maxLines = limit
+	}
+	maxBytes := int64(q.limits.ReturnMB) << 20
+
+	for _, t := range q.targets {
+		if q.ctx.Err() != nil {
+			return res, q.stopped()
+		}
+
+		budget := int64(-1)
+		if q.limits.ScanMB > 0 {
+			budget = max(int64(q.limits.ScanMB)<<20-q.scanned, 0)
+		}
+
+		stats, err := scanFile(q.ctx, q.matcher, q.window, t.file, budget, func(line grep.Line) error {
+			if countOnly {
+				return nil
+			}
+			if res.Truncated || (maxLines > 0 && emitted >= maxLines) || (maxBytes > 0 && q.sent+int64(len(line.Text)) > maxBytes) {
+				// nothing is sent past the first line over a limit, not even
+				// shorter lines that would fit, but matches are still counted
+				res.Truncated = true
+				return nil
+			}
+			emitted++
+			err := emit(api.Match{
+				Source:  t.source,
+				File:    t.file,
+				Line:    line.Number,
+				Offset:  line.Offset,
+				Text:    line.Text,
+				Context: line.Context,
+			})
+			if err == nil {
+				q.sent += int64(len(line.Text))
+			}
 			return err
+		})
+		matches := stats.Matches
+		res.Total += matches
+		q.scanned += stats.BytesScanned
+
+		if q.ctx.Err() != nil {
+			return res, q.stopped()
+		}
+		if errors.Is(err, errScanLimit) {
+			log.Printf("query %s hit the scan limit", q.id)
+			return res, api.Errorf(api.CodeLimit, "error: query %s stopped after reading %dMB, the server's limit", q.id, q.limits.ScanMB)
+		}
+		if err != nil {
+			failure := fmt.Sprintf("grep: %s: %v", t.file, err)
+			log.Println(failure)
+			res.Errors = append(res.Errors, failure)
+			continue
 		}
-	}			
+		res.Counts[t.file] = matches
+	}
 
-	output := string(out)
+	res.Elapsed = time.Since(start)
+	log.Printf("search %q: %d matches in %s", q.req.Pattern, res.Total, res.Elapsed)
 
-	counter_args := append([]string{"-c"}, tokens[1:]...)
-	cmd_counter := exec.Command(tokens[0], counter_args...)
+	switch {
+	case res.Total > 0:
+	case len(q.targets) > 0 && len(res.Errors) == len(q.targets):
+		// nothing could be read, which is not the same as nothing matching
+		return res, api.Errorf(api.CodeSourceMissing, "%s", strings.Join(res.Errors, "\n"))
+	default:
+		res.Status = api.Status{Code: api.CodeNoMatch, Message: "no match found"}
+	}
+	return res, nil
+}
 
-	out_counter, err := cmd_counter.CombinedOutput()
+// explains why a query stopped before scanning everything
+func (q *query) stopped() error {
+	if errors.Is(q.ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("query %s timed out", q.id)
+		return api.Errorf(api.CodeTimeout, "error: query %s timed out", q.id)
+	}
+	log.Printf("query %s cancelled", q.id)
+	return api.Errorf(api.CodeCancelled, "error: query %s cancelled", q.id)
+}
 
-	if err == nil {
-		output = output + "\nMATCHES: " + strings.TrimSpace(string(out_counter))
+// runs the matcher over a single file, or the part of it inside window if
+// there is one, returns the number of selected lines and bytes read
+// compressed files are searched as the text they hold, see decompress
+// reading stops with errScanLimit after budget bytes, a negative budget has no limit
+func scanFile(ctx context.Context, matcher *grep.Matcher, window *window, file string, budget int64, emit func(grep.Line) error) (grep.Stats, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		// the caller already names the file
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return grep.Stats{}, pathErr.Err
+		}
+		return grep.Stats{}, err
 	}
+	defer f.Close()
 
-	*reply = output
-	return nil
+	text, compressed, err := decompress(f)
+	if err != nil {
+		return grep.Stats{}, err
+	}
+	defer text.Close()
+
+	var r io.Reader = text
+	if budget >= 0 {
+		r = &budgetReader{r: text, n: budget}
+	}
+	if window == nil {
+		return matcher.Scan(ctx, r, emit)
+	}
+	if compressed {
+		// cannot seek into a compressed file, every line is filtered instead
+		return matcher.ScanRegion(ctx, r, grep.Region{Keep: window.keep(false)}, emit)
+	}
+
+	region, err := window.region(ctx, f)
+	if err != nil {
+		return grep.Stats{}, err
+	}
+	if region.Offset > 0 {
+		log.Printf("%s: skipped %d bytes (%d lines) before the time range", file, region.Offset, region.Line)
+	}
+	return matcher.ScanRegion(ctx, r, region, emit)
 }
 
 // this is an RPC function which can be called remotely
 // 
-// verifies a connection is made to a client
+// verifies a connection is made to a client, see VM.Status for more
+// clients probe with it every few seconds, so it does not log
 func (vm *VM) ConfirmConnection(str string, reply *string) error {
 	*reply = fmt.Sprintf("status: connected to %s", str)
-	log.Println(*reply)
 	return nil
 }
 
+// set by the -drain-timeout flag, see shutdownOnSignal
+var drainTimeout time.Duration
+
+// loads the server config from -config and/or -source flags
+// with neither, the VM serves its course log picked by hostname
+func loadConfig() *config.Server {
+	configPath := flag.String("config", "", "path to a JSON server config")
+	accessPath := flag.String("access", "", "path to a JSON access policy (overrides the config)")
+	auditPath := flag.String("audit", "", "file to record every query in, served as the source audit (default audit.log)")
+	auditMaxMB := flag.Int("audit-max-mb", 0, "rotate the audit log once it reaches this size (default 10)")
+	auditKeep := flag.Int("audit-keep", 0, "rotated audit logs to keep (default 5)")
+	port := flag.Int("port", 0, "port to listen on (overrides the config)")
+	limits := config.Limits{}
+	flag.IntVar(&limits.Queries, "max-queries", 0, "queries running at once (default the number of CPUs)")
+	flag.IntVar(&limits.Queue, "max-queued", 0, "queries waiting for a slot before more are refused as overloaded (default 4 per slot)")
+	flag.IntVar(&limits.Follows, "max-follows", 0, "subscriptions open at once before more are refused as overloaded (default 4 per slot)")
+	flag.IntVar(&limits.ScanMB, "max-scan-mb", 0, "stop a query after it reads this many MB of logs (default unlimited)")
+	flag.IntVar(&limits.ReturnMB, "max-return-mb", 0, "truncate a query's lines after this many MB (default 64)")
+	flag.IntVar(&limits.Lines, "max-lines", 0, "truncate a query after this many lines (default unlimited)")
+	rate := &config.Rate{}
+	flag.Float64Var(&rate.PerSecond, "rate", 0, "queries a second each caller may send on average (default unlimited)")
+	flag.IntVar(&rate.Burst, "rate-burst", 0, "queries a caller may send at once under -rate (default -rate rounded up)")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "how long running queries may finish after SIGTERM before they are cancelled")
+	var sources []config.Source
+	tlsFiles := &config.TLS{}
+	flag.StringVar(&tlsFiles.Cert, "tls-cert", "", "certificate to serve TLS with (overrides the config)")
+	flag.StringVar(&tlsFiles.Key, "tls-key", "", "key for -tls-cert")
+	flag.StringVar(&tlsFiles.CA, "tls-ca", "", "CA that client certificates must be signed by; without it clients are not verified")
+	flag.Func("source", "log source as name[:numbered|:dated]=path[,path...], may be repeated", func(value string) error {
+		src, err := config.ParseSourceFlag(value)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, src)
+		return nil
+	})
+	flag.Parse()
+
+	cfg := &config.Server{}
+	if *configPath != "" {
+		loaded, err := config.LoadServer(*configPath)
+		if err != nil {
+			log.Fatalf("error loading config: %v", err)
+		}
+		cfg = loaded
+	}
+
+	cfg.Sources = append(cfg.Sources, sources...)
+	if len(cfg.Sources) == 0 {
+		cfg.Sources = []config.Source{{Name: "log", Paths: []string{defaultLog()}}}
+	}
+	if *port != 0 {
+		cfg.Port = *port
+	}
+	if tlsFiles.Enabled() {
+		cfg.TLS = tlsFiles
+	}
+	if err := loadAccess(cfg, *accessPath); err != nil {
+		log.Fatalf("error loading access policy: %v", err)
+	}
+	if *auditPath != "" {
+		cfg.Audit = *auditPath
+	}
+	if cfg.Audit == "" {
+		cfg.Audit = "audit.log"
+	}
+	if *auditMaxMB != 0 {
+		cfg.AuditMaxMB = *auditMaxMB
+	}
+	if cfg.AuditMaxMB == 0 {
+		cfg.AuditMaxMB = 10
+	}
+	if *auditKeep != 0 {
+		cfg.AuditKeep = *auditKeep
+	}
+	if cfg.AuditKeep == 0 {
+		cfg.AuditKeep = 5
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 4425
+	}
+	setLimits(&cfg.Limits, limits)
+	if rate.PerSecond != 0 {
+		cfg.Rate = rate
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("error in config: %v", err)
+	}
+	cfg.AddAuditSource()
+	return cfg
+}
+
+// applies the limits given as flags over the config's and fills in defaults
+func setLimits(l *config.Limits, flags config.Limits) {
+	override := func(v *int, flag int) {
+		if flag != 0 {
+			*v = flag
+		}
+	}
+	override(&l.Queries, flags.Queries)
+	override(&l.Queue, flags.Queue)
+	override(&l.Follows, flags.Follows)
+	override(&l.ScanMB, flags.ScanMB)
+	override(&l.ReturnMB, flags.ReturnMB)
+	override(&l.Lines, flags.Lines)
+
+	if l.Queries == 0 {
+		l.Queries = runtime.NumCPU()
+	}
+	if l.Queue == 0 {
+		l.Queue = 4 * l.Queries
+	}
+	if l.Follows == 0 {
+		l.Follows = 4 * l.Queries
+	}
+	if l.ReturnMB == 0 {
+		l.ReturnMB = 64
+	}
+}
+
 func main() {
-	vm := &VM{}
-	const portno int = 4425
-	
-	 if err := rpc.Register(vm); err != nil {
-		log.Fatalf("error registering %v", err)	
+	cfg := loadConfig()
+	vm := &VM{
+		cfg:     cfg,
+		streams: newStreams(),
+		running: newRunning(),
+		metrics: newMetrics(),
+		started: time.Now(),
+		admit:   newAdmission(cfg.Limits.Queries, cfg.Limits.Queue),
+		follows: make(chan struct{}, cfg.Limits.Follows),
+		rates:   newRateLimiter(),
 	}
+	portno := cfg.Port
 
-	rpc.HandleHTTP()
+	audit, err := openAudit(cfg.Audit, int64(cfg.AuditMaxMB)<<20, cfg.AuditKeep)
+	if err != nil {
+		log.Fatalf("error opening audit log: %v", err)
+	}
+	vm.audit = audit
+	log.Printf("running %d queries at once, %d queued", cfg.Limits.Queries, cfg.Limits.Queue)
+	if cfg.Rate != nil {
+		log.Printf("limiting each caller to %g queries a second, %d at once", cfg.Rate.PerSecond, cfg.Rate.Burst)
+	}
+	log.Printf("auditing queries to %s (rotated at %dMB, %d kept)", cfg.Audit, cfg.AuditMaxMB, cfg.AuditKeep)
+	if cfg.Access != nil {
+		log.Printf("access policy with %d grants", len(cfg.Access.Grants))
+	}
+
+	for _, src := range cfg.Sources {
+		log.Printf("serving source %s: %v", src.Name, src.Paths)
+	}
+
+	http.Handle(rpc.DefaultRPCPath, connHandler{vm})
+	http.HandleFunc("/metrics", vm.serveMetrics)
+	http.HandleFunc("/healthz", vm.serveHealth)
+	http.HandleFunc("/readyz", vm.serveReady)
 	listener, err := net.Listen("tcp", ":"+strconv.Itoa(portno))
 	if err != nil {
 		log.Fatalf("error listening: %v", err)
 	}
 
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := cfg.TLS.ServerConfig()
+		if err != nil {
+			log.Fatalf("error in config: %v", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		if tlsConfig.ClientCAs != nil {
+			log.Println("serving TLS, client certificates required")
+		} else {
+			log.Println("serving TLS")
+		}
+	}
+
 	vm.listener = listener
 
+	srv := &http.Server{}
+	done := make(chan struct{})
+	go vm.shutdownOnSignal(srv, drainTimeout, done)
+
 	log.Printf("listening on port %d\n", portno)
-	   if err := http.Serve(listener, nil); err != nil {
-	       log.Fatalf("error serving: %v", err)
-	   }
+	if err := srv.Serve(listener); err != http.ErrServerClosed {
+		log.Fatalf("error serving: %v", err)
+	}
+	<-done
 }
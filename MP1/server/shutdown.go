@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	// how often draining checks whether the last query is over
+	drainPoll = 100 * time.Millisecond
+	// how long cancelled queries get to stop once the drain timeout is up
+	cancelWait = 5 * time.Second
+)
+
+// waits for SIGTERM or SIGINT and then shuts the server down: the listener
+// is closed and new queries are refused with code overloaded, subscriptions
+// are stopped, running and open streaming queries get until timeout to
+// finish before they are cancelled, and the audit log is flushed; a second
+// signal exits at once
+//
+// done is closed once the server can exit
+func (vm *VM) shutdownOnSignal(srv *http.Server, timeout time.Duration, done chan<- struct{}) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-signals
+	log.Printf("%v received, draining queries for up to %s", sig, timeout)
+	go func() {
+		sig := <-signals
+		log.Printf("%v received again, exiting now", sig)
+		os.Exit(1)
+	}()
+
+	vm.running.close()
+	// subscriptions never end on their own
+	vm.streams.stopFollows()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// RPC connections are hijacked, so this only stops the listener and
+	// the plain HTTP endpoints; queries are drained below
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("error closing listener: %v", err)
+	}
+
+	if !vm.drain(ctx) {
+		log.Printf("%d queries and %d streams still open, cancelling them", vm.running.count(), vm.streams.count())
+		vm.running.cancelAll()
+		vm.streams.removeAll()
+		wait, cancel := context.WithTimeout(context.Background(), cancelWait)
+		defer cancel()
+		vm.drain(wait)
+	}
+
+	if err := vm.audit.close(); err != nil {
+		log.Printf("error closing audit log: %v", err)
+	}
+	log.Println("shut down")
+	close(done)
+}
+
+// waits until no query is running and every stream has been read to its end
+// or closed by its client; reports false if ctx ended first
+func (vm *VM) drain(ctx context.Context) bool {
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for vm.running.count() > 0 || vm.streams.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"gb4/api"
+	"gb4/config"
+)
+
+// set at build time with -ldflags "-X main.version=v1.2"; when empty the
+// commit the server was built from is reported instead, if known
+var version string
+
+func serverVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				return setting.Value[:12]
+			}
+		}
+	}
+	return "dev"
+}
+
+// this is an RPC function that can be called remotely
+//
+// reports the server's version, uptime, load and the state of every
+// configured source; the argument is a token, with an access policy only the
+// sources its grant allows are described
+func (vm *VM) Status(token string, reply *api.ServerStatus) error {
+	*reply = vm.status(vm.visible(token))
+	return nil
+}
+
+// readiness covers every source, but only the visible ones are described
+func (vm *VM) status(visible func(source string) bool) api.ServerStatus {
+	hostname, _ := os.Hostname()
+	active, waiting := vm.admit.load()
+	status := api.ServerStatus{
+		Version:  serverVersion(),
+		Hostname: hostname,
+		Started:  vm.started,
+		Uptime:   time.Since(vm.started).Round(time.Second),
+		Running:  active,
+		Queued:   waiting,
+		Streams:  vm.streams.count(),
+		LoadAvg:  loadAvg(),
+		Ready:    true,
+	}
+
+	if vm.running.isClosed() {
+		status.Ready = false
+		status.Problems = append(status.Problems, "shutting down")
+	}
+	hidden := 0
+	for _, src := range vm.cfg.Sources {
+		source := sourceStatus(src)
+		switch {
+		case !visible(src.Name):
+			if !source.Readable {
+				status.Ready = false
+				hidden++
+			}
+			continue
+		case !source.Readable:
+			status.Ready = false
+			status.Problems = append(status.Problems, fmt.Sprintf("source %s has no readable files", src.Name))
+		}
+		status.Sources = append(status.Sources, source)
+	}
+	if hidden > 0 {
+		status.Problems = append(status.Problems, fmt.Sprintf("sources not shown with no readable files: %d", hidden))
+	}
+	return status
+}
+
+// stats and opens every file of a source
+func sourceStatus(src config.Source) api.SourceStatus {
+	source := api.SourceStatus{Name: src.Name}
+	files, err := src.Files()
+	if err != nil {
+		source.Files = []api.FileStatus{{Err: err.Error()}}
+		return source
+	}
+
+	for _, path := range files {
+		file := api.FileStatus{Path: path}
+		if info, err := os.Stat(path); err != nil {
+			file.Err = err.Error()
+		} else {
+			file.Size, file.ModTime = info.Size(), info.ModTime()
+			if f, err := os.Open(path); err != nil {
+				file.Err = err.Error()
+			} else {
+				f.Close()
+				source.Readable = true
+			}
+		}
+		source.Files = append(source.Files, file)
+	}
+	return source
+}
+
+// the system load averages, zero where /proc/loadavg is not available
+func loadAvg() [3]float64 {
+	var avg [3]float64
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return avg
+	}
+	fields := strings.Fields(string(data))
+	for i := 0; i < len(avg) && i < len(fields); i++ {
+		avg[i], _ = strconv.ParseFloat(fields[i], 64)
+	}
+	return avg
+}
+
+// serves /healthz, which answers 200 as long as the server is up
+// sources are described as for VM.Status, to the token of an
+// "Authorization: Bearer TOKEN" header
+func (vm *VM) serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, vm.status(vm.visible(bearerToken(r))))
+}
+
+// serves /readyz, which answers 503 until every source can be read
+func (vm *VM) serveReady(w http.ResponseWriter, r *http.Request) {
+	status := vm.status(vm.visible(bearerToken(r)))
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeStatus(w, code, status)
+}
+
+func writeStatus(w http.ResponseWriter, code int, status api.ServerStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"gb4/api"
+)
+
+const (
+	// lines buffered per open query; the scan blocks once this many are waiting
+	streamBuffer = 256
+	// lines per batch when the client does not ask for a size
+	defaultBatch = 100
+	// how long Next waits for a first line before returning an empty batch
+	batchWait = 500 * time.Millisecond
+	// open queries that see no Next call for this long are closed
+	streamIdle = 2 * time.Minute
+)
+
+// an open query whose lines are handed out batch by batch
+type stream struct {
+	lines  chan api.Match
+	stop   context.CancelFunc
+	follow bool  // a subscription from VM.Follow
+	owner  owner // the connection that opened it
+
+	// written by the scanning goroutine before lines is closed
+	summary api.GrepReply
+	err     error
+
+	mu       sync.Mutex
+	lastUsed time.Time
+}
+
+// the set of open queries on this server
+type streams struct {
+	mu   sync.Mutex
+	open map[string]*stream
+}
+
+func newStreams() *streams {
+	s := &streams{open: make(map[string]*stream)}
+	go s.reap()
+	return s
+}
+
+// adds an open query, reports false if one with the same id is still open
+func (s *streams) add(id string, st *stream) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.open[id]; ok {
+		return false
+	}
+	s.open[id] = st
+	return true
+}
+
+func (s *streams) has(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.open[id]
+	return ok
+}
+
+func (s *streams) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.open)
+}
+
+// returns a query opened by by; other connections' queries look like
+// unknown ones, so their ids cannot be probed either
+func (s *streams) get(id string, by owner) (*stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.open[id]
+	if ok && !st.owner.is(by) {
+		log.Printf("query %s: %s tried to use a query of %s", id, by.caller, st.owner.identity)
+		ok = false
+	}
+	if !ok {
+		// closed, reaped, never opened or not the caller's
+		return nil, api.Errorf(api.CodeInvalidQuery, "error: unknown query %s", id)
+	}
+	return st, nil
+}
+
+// stops the scan behind a query of by's but keeps it until its last batch
+// is read, reports whether the query was open
+func (s *streams) stop(id string, by owner) bool {
+	st, err := s.get(id, by)
+	if err != nil {
+		return false
+	}
+	st.stop()
+	return true
+}
+
+// stops every subscription, for shutdown; their clients still get a last batch
+func (s *streams) stopFollows() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.open {
+		if st.follow {
+			st.stop()
+		}
+	}
+}
+
+// stops the scan behind a query and forgets it
+func (s *streams) remove(id string) {
+	s.mu.Lock()
+	st, ok := s.open[id]
+	delete(s.open, id)
+	s.mu.Unlock()
+
+	if ok {
+		st.stop()
+	}
+}
+
+// stops and forgets every open query
+func (s *streams) removeAll() {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.open))
+	for id := range s.open {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		s.remove(id)
+	}
+}
+
+// closes queries abandoned by their client
+func (s *streams) reap() {
+	for range time.Tick(streamIdle / 4) {
+		s.mu.Lock()
+		var idle []string
+		for id, st := range s.open {
+			st.mu.Lock()
+			if time.Since(st.lastUsed) > streamIdle {
+				idle = append(idle, id)
+			}
+			st.mu.Unlock()
+		}
+		s.mu.Unlock()
+
+		for _, id := range idle {
+			log.Printf("closing idle query %s", id)
+			s.remove(id)
+		}
+	}
+}
+
+func (st *stream) touch() {
+	st.mu.Lock()
+	st.lastUsed = time.Now()
+	st.mu.Unlock()
+}
+
+// this is an RPC function that can be called remotely
+//
+// starts a query and returns its id; lines are then fetched with VM.Next
+// the scan runs ahead of the client by at most streamBuffer lines
+// a query that cannot start is reported in the reply's Status, not as an RPC error
+func (vm *VM) Open(req api.GrepRequest, reply *api.OpenReply) error {
+	return vm.open(req, reply, false)
+}
+
+// this is an RPC function that can be called remotely
+//
+// subscribes to lines appended to the requested sources from now on that
+// match the query; like VM.Open, but the query only ends when it is closed
+// or cancelled, see query.follow
+func (vm *VM) Follow(req api.GrepRequest, reply *api.OpenReply) error {
+	return vm.open(req, reply, true)
+}
+
+func (vm *VM) open(req api.GrepRequest, reply *api.OpenReply, follow bool) error {
+	q, err := vm.prepare(req, follow)
+	if err != nil {
+		*reply = api.OpenReply{Status: api.StatusOf(err)}
+		return nil
+	}
+
+	// closing the stream cancels the scan; the deadline still applies
+	ctx, stop := context.WithCancel(q.ctx)
+	q.ctx = ctx
+
+	st := &stream{
+		lines:    make(chan api.Match, streamBuffer),
+		stop:     stop,
+		follow:   follow,
+		owner:    vm.owner(q.identity),
+		lastUsed: time.Now(),
+	}
+	if !vm.streams.add(q.id, st) {
+		// another Open with the same id got there first
+		stop()
+		q.finish()
+		err := api.Errorf(api.CodeInvalidQuery, "error: query %s is already running", q.id)
+		vm.report(q.record(api.GrepReply{}, err))
+		*reply = api.OpenReply{Status: api.StatusOf(err)}
+		return nil
+	}
+
+	produce := q.run
+	if follow {
+		produce = q.follow
+	}
+	go func() {
+		defer q.finish()
+		st.summary, st.err = produce(func(m api.Match) error {
+			select {
+			case st.lines <- m:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if follow && vm.running.isClosed() && api.CodeOf(st.err) == api.CodeCancelled {
+			// stopped by stopFollows, not by its client
+			st.err = api.Errorf(api.CodeOverloaded, "error: server is shutting down")
+		}
+		vm.report(q.record(st.summary, st.err))
+		close(st.lines)
+	}()
+
+	hostname, _ := os.Hostname()
+	*reply = api.OpenReply{QueryID: q.id, Files: q.files(), Hostname: hostname}
+	return nil
+}
+
+// this is an RPC function that can be called remotely
+//
+// returns the next batch of lines for an open query
+// an empty batch that is not Done means nothing was ready yet, call again
+func (vm *VM) Next(req api.NextRequest, reply *api.Batch) error {
+	st, err := vm.streams.get(req.QueryID, vm.owner(""))
+	if err != nil {
+		*reply = api.Batch{Done: true, Summary: api.GrepReply{Status: api.StatusOf(err)}}
+		return nil
+	}
+	st.touch()
+	defer st.touch()
+
+	max := req.MaxLines
+	if max <= 0 {
+		max = defaultBatch
+	}
+
+	var batch api.Batch
+	timer := time.NewTimer(batchWait)
+	defer timer.Stop()
+
+	// wait a little for the first line, then take whatever else is ready
+	select {
+	case m, ok := <-st.lines:
+		if !ok {
+			return vm.finish(req.QueryID, st, reply)
+		}
+		batch.Matches = append(batch.Matches, m)
+	case <-timer.C:
+		*reply = batch
+		return nil
+	}
+
+	for len(batch.Matches) < max {
+		select {
+		case m, ok := <-st.lines:
+			if !ok {
+				*reply = batch
+				return vm.finish(req.QueryID, st, reply)
+			}
+			batch.Matches = append(batch.Matches, m)
+		default:
+			*reply = batch
+			return nil
+		}
+	}
+
+	*reply = batch
+	return nil
+}
+
+// marks the batch as the last one and attaches the query summary, with the
+// error that stopped the scan, if any, in its status
+func (vm *VM) finish(id string, st *stream, reply *api.Batch) error {
+	vm.streams.remove(id)
+	reply.Done = true
+	reply.Summary = st.summary
+	if st.err != nil {
+		reply.Summary.Status = api.StatusOf(st.err)
+	}
+	return nil
+}
+
+// this is an RPC function that can be called remotely
+//
+// stops an open query early and frees its buffer; reply is false if the
+// connection has no open query with that id
+func (vm *VM) Close(id string, reply *bool) error {
+	if _, err := vm.streams.get(id, vm.owner("")); err != nil {
+		*reply = false
+		return nil
+	}
+	vm.streams.remove(id)
+	*reply = true
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"gb4/api"
+	"gb4/grep"
+	"gb4/logtime"
+)
+
+const (
+	// below this many bytes the binary search stops and the rest is scanned
+	seekMin = 64 * 1024
+	// how far past a probe point to look for a line with a timestamp
+	probeLimit = 64 * 1024
+	// evenly spaced probes used to check a file is in time order
+	sortProbes = 8
+)
+
+// the --since/--until range of a query
+type window struct {
+	since  time.Time // zero means unbounded
+	until  time.Time
+	parser *logtime.Parser
+}
+
+// returns nil if the request has no time range
+func newWindow(req api.GrepRequest) (*window, error) {
+	if req.Since.IsZero() && req.Until.IsZero() {
+		return nil, nil
+	}
+	if !req.Since.IsZero() && !req.Until.IsZero() && req.Until.Before(req.Since) {
+		return nil, api.Errorf(api.CodeInvalidQuery, "error: until %s is before since %s",
+			req.Until.Format(time.RFC3339), req.Since.Format(time.RFC3339))
+	}
+	parser, err := logtime.NewParser(req.TimeLayouts)
+	if err != nil {
+		return nil, api.Errorf(api.CodeInvalidQuery, "error: %v", err)
+	}
+	return &window{since: req.Since, until: req.Until, parser: parser}, nil
+}
+
+// -1 if t is before the window, 1 if after it, 0 inside
+func (w *window) place(t time.Time) int {
+	switch {
+	case !w.since.IsZero() && t.Before(w.since):
+		return -1
+	case !w.until.IsZero() && t.After(w.until):
+		return 1
+	}
+	return 0
+}
+
+// drops the files of rotated logs that cannot hold a line inside the window:
+// a rotated file runs from its first timestamp to the first timestamp of the
+// next newer file in its history, and the live log from its first timestamp
+// on, so it is only dropped if it starts after the window; a file without a
+// timestamp near its start has no beginning, and files that are not rotated
+// are always kept
+func (w *window) prune(targets []target) []target {
+	starts := make(map[string]time.Time)
+	start := func(file string) (time.Time, bool) {
+		t, ok := starts[file]
+		if !ok {
+			t, ok = w.first(file)
+			starts[file] = t // the zero time if there is none
+		}
+		return t, !t.IsZero()
+	}
+
+	kept := targets[:0:0]
+	for _, t := range targets {
+		if t.rotated {
+			begin, hasBegin := start(t.file)
+			end, hasEnd := time.Time{}, false
+			if t.newer != "" {
+				end, hasEnd = start(t.newer)
+			}
+			if (hasBegin && w.place(begin) == 1) || (hasEnd && w.place(end) == -1) {
+				log.Printf("%s: outside the time range, skipped", t.file)
+				continue
+			}
+		}
+		kept = append(kept, t)
+	}
+	return kept
+}
+
+// the first timestamp within probeLimit bytes of the start of a file's text,
+// compressed or not
+func (w *window) first(file string) (time.Time, bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+	text, _, err := decompress(f)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer text.Close()
+
+	buf := make([]byte, probeLimit)
+	n, _ := io.ReadFull(text, buf)
+	for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+		if t, ok := w.parser.Parse(string(line)); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// works out the part of f to scan for the window
+//
+// if f looks like it is in time order (sampled at a few points) the start is
+// found by binary search over byte offsets and the scan stops at the first line
+// past the window; otherwise the whole file is scanned and every line filtered
+// either way lines are numbered as in the whole file
+func (w *window) region(ctx context.Context, f *os.File) (grep.Region, error) {
+	var start int64
+	sorted := false
+
+	info, err := f.Stat()
+	if err != nil {
+		return grep.Region{}, err
+	}
+	if info.Mode().IsRegular() {
+		sorted = w.sorted(f, info.Size())
+		if sorted && !w.since.IsZero() {
+			start = w.seek(f, info.Size())
+		}
+	}
+
+	region := grep.Region{Offset: start, Keep: w.keep(sorted)}
+	if start > 0 {
+		if region.Line, err = countLines(ctx, f, start); err != nil {
+			return grep.Region{}, err
+		}
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return grep.Region{}, err
+	}
+	return region, nil
+}
+
+// the filter for grep.Region.Keep
+// lines without a timestamp belong with the line before them, lines before
+// the first timestamp are dropped since their time is unknown
+func (w *window) keep(sorted bool) func([]byte) (bool, bool) {
+	var last time.Time
+	known := false
+	return func(text []byte) (keep, stop bool) {
+		if t, ok := w.parser.Parse(string(text)); ok {
+			last, known = t, true
+		}
+		if !known {
+			return false, false
+		}
+		switch w.place(last) {
+		case -1:
+			return false, false
+		case 1:
+			// nothing later in a sorted file can be inside the window
+			return false, sorted
+		}
+		return true, false
+	}
+}
+
+// reports whether timestamps sampled across the file never go backwards
+func (w *window) sorted(f *os.File, size int64) bool {
+	var prev time.Time
+	for i := int64(0); i < sortProbes; i++ {
+		t, ok := w.probe(f, size*i/sortProbes)
+		if !ok {
+			continue
+		}
+		if t.Before(prev) {
+			return false
+		}
+		prev = t
+	}
+	return true
+}
+
+// returns an offset before the first line inside the window, assuming the file
+// is sorted; lines between it and the window are skipped by keep
+func (w *window) seek(f *os.File, size int64) int64 {
+	lo, hi := int64(0), size
+	for hi-lo > seekMin {
+		mid := lo + (hi-lo)/2
+		if t, ok := w.probe(f, mid); ok && t.Before(w.since) {
+			lo = mid
+		} else {
+			// at or past the start, or no timestamp nearby: look earlier
+			hi = mid
+		}
+	}
+	if lo == 0 {
+		return 0
+	}
+	return nextLine(f, lo)
+}
+
+// timestamp of the first dated line starting after offset
+func (w *window) probe(f *os.File, offset int64) (time.Time, bool) {
+	buf := make([]byte, probeLimit)
+	n, _ := f.ReadAt(buf, offset)
+	buf = buf[:n]
+
+	if offset > 0 {
+		// skip the line offset falls in, it may be partial
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return time.Time{}, false
+		}
+		buf = buf[i+1:]
+	}
+	for len(buf) > 0 {
+		line, rest, found := bytes.Cut(buf, []byte("\n"))
+		if !found && n == probeLimit {
+			// the last line may be cut off
+			break
+		}
+		if t, ok := w.parser.Parse(string(line)); ok {
+			return t, true
+		}
+		buf = rest
+	}
+	return time.Time{}, false
+}
+
+// offset of the start of the first line after offset
+func nextLine(f *os.File, offset int64) int64 {
+	buf := make([]byte, 4096)
+	for {
+		n, err := f.ReadAt(buf, offset)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return offset + int64(i) + 1
+		}
+		offset += int64(n)
+		if err != nil {
+			return offset
+		}
+	}
+}
+
+// counts the lines in the first n bytes of f so skipped lines keep their numbers
+// this only reads, no line is matched or parsed
+func countLines(ctx context.Context, f *os.File, n int64) (int, error) {
+	buf := make([]byte, 1024*1024)
+	lines := 0
+	for offset := int64(0); offset < n; {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		chunk := buf
+		if n-offset < int64(len(chunk)) {
+			chunk = chunk[:n-offset]
+		}
+		read, err := f.ReadAt(chunk, offset)
+		lines += bytes.Count(chunk[:read], []byte("\n"))
+		offset += int64(read)
+		if err != nil && offset < n {
+			return 0, err
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gb4/api"
+	"gb4/grep"
+)
+
+// writes a log with a line at each of the given times, e.g. "03:00"
+func writeLog(t *testing.T, path string, times ...string) {
+	t.Helper()
+	var b strings.Builder
+	for _, at := range times {
+		b.WriteString("2024-01-02T" + at + ":00Z line\n")
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a window from since to until on 2024-01-02, either may be empty
+func testWindow(t *testing.T, since, until string) *window {
+	t.Helper()
+	var req api.GrepRequest
+	if since != "" {
+		req.Since, _ = time.Parse(time.RFC3339, "2024-01-02T"+since+":00Z")
+	}
+	if until != "" {
+		req.Until, _ = time.Parse(time.RFC3339, "2024-01-02T"+until+":00Z")
+	}
+	w, err := newWindow(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, "app.log")
+	writeLog(t, live, "03:00", "03:30")
+	writeLog(t, live+".1", "02:00", "02:30")
+	writeLog(t, live+".2", "01:00", "01:30")
+	plain := filepath.Join(dir, "plain.log")
+	writeLog(t, plain, "05:00")
+	untimed := live + ".3"
+	os.WriteFile(untimed, []byte("no timestamp here\n"), 0o644)
+
+	targets := []target{
+		{file: untimed, rotated: true, newer: live + ".2"},
+		{file: live + ".2", rotated: true, newer: live + ".1"},
+		{file: live + ".1", rotated: true, newer: live},
+		{file: live, rotated: true},
+		{file: plain},
+	}
+	tests := []struct {
+		since, until string
+		want         []string
+	}{
+		{"02:10", "02:20", []string{live + ".1", plain}},
+		// .1 ends where the live log starts
+		{"02:10", "03:10", []string{live + ".1", live, plain}},
+		// the live log has no end
+		{"09:00", "", []string{live, plain}},
+		// the untimed file ends where .2 starts, but has no start
+		{"", "00:30", []string{untimed, plain}},
+		{"01:00", "01:00", []string{untimed, live + ".2", plain}},
+		{"03:00", "03:00", []string{live + ".1", live, plain}},
+	}
+	for _, tt := range tests {
+		w := testWindow(t, tt.since, tt.until)
+		var got []string
+		for _, kept := range w.prune(append([]target(nil), targets...)) {
+			got = append(got, kept.file)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("since %q until %q: kept %q, want %q", tt.since, tt.until, got, tt.want)
+		}
+	}
+}
+
+// a sorted log of n lines two seconds apart from midnight; every tenth line
+// is a stack trace line without a timestamp
+// returns its text and the time each line belongs to
+func sortedLog(n int) (string, []time.Time) {
+	var b strings.Builder
+	times := make([]time.Time, n)
+	base := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		times[i] = base.Add(time.Duration(i) * 2 * time.Second)
+		if i%10 == 9 {
+			times[i] = times[i-1]
+			b.WriteString("\tat trace\n")
+			continue
+		}
+		b.WriteString(times[i].Format(time.RFC3339) + " line\n")
+	}
+	return b.String(), times
+}
+
+func TestSeek(t *testing.T) {
+	text, times := sortedLog(40000)
+	path := filepath.Join(t.TempDir(), "app.log")
+	os.WriteFile(path, []byte(text), 0o644)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// byte offset of every line
+	var offsets []int64
+	for i, off := 0, int64(0); i < len(times); i++ {
+		offsets = append(offsets, off)
+		off += int64(strings.IndexByte(text[off:], '\n') + 1)
+	}
+
+	last := times[len(times)-1]
+	tests := []struct {
+		name  string
+		since time.Time
+	}{
+		{"before the first line", times[0].Add(-time.Hour)},
+		{"at the first line", times[0]},
+		{"at the second line", times[1]},
+		{"at a line", times[20001]},
+		{"between lines", times[20001].Add(time.Second)},
+		{"at a trace line's time", times[29]},
+		{"at the last line", last},
+		{"after the last line", last.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		w := &window{since: tt.since, parser: testWindow(t, "00:00", "").parser}
+		off := w.seek(f, int64(len(text)))
+
+		// the first line inside the window, or the end
+		first := len(times)
+		for i, at := range times {
+			if !at.Before(tt.since) {
+				first = i
+				break
+			}
+		}
+		firstOff := int64(len(text))
+		if first < len(times) {
+			firstOff = offsets[first]
+		}
+		switch {
+		case off != 0 && text[off-1] != '\n':
+			t.Errorf("%s: offset %d is not the start of a line", tt.name, off)
+		case off > firstOff:
+			t.Errorf("%s: offset %d skips line %d at %d", tt.name, off, first+1, firstOff)
+		case firstOff-off > seekMin+128:
+			t.Errorf("%s: offset %d is %d bytes before line %d", tt.name, off, firstOff-off, first+1)
+		}
+	}
+}
+
+func TestKeep(t *testing.T) {
+	lines := []string{
+		"no time yet",
+		"2024-01-02T01:00:00Z before",
+		"\tat before",
+		"2024-01-02T02:00:00Z start",
+		"\tat start",
+		"2024-01-02T02:30:00Z inside",
+		"2024-01-02T03:00:00Z end",
+		"2024-01-02T03:00:01Z after",
+		"\tat after",
+	}
+	tests := []struct {
+		sorted bool
+		keep   []bool
+		stop   int // index of the line that stops the scan, -1 for none
+	}{
+		{true, []bool{false, false, false, true, true, true, true, false, false}, 7},
+		{false, []bool{false, false, false, true, true, true, true, false, false}, -1},
+	}
+	for _, tt := range tests {
+		keep := testWindow(t, "02:00", "03:00").keep(tt.sorted)
+		for i, line := range lines {
+			kept, stop := keep([]byte(line))
+			if stop != (i == tt.stop) {
+				t.Errorf("sorted=%v line %q: stop %v", tt.sorted, line, stop)
+			}
+			if stop {
+				break
+			}
+			if kept != tt.keep[i] {
+				t.Errorf("sorted=%v line %q: keep %v, want %v", tt.sorted, line, kept, tt.keep[i])
+			}
+		}
+	}
+}
+
+// searching a window finds the same lines, with the same numbers, as filtering
+// the whole file would, sorted or not
+func TestRegion(t *testing.T) {
+	text, _ := sortedLog(20000)
+	dir := t.TempDir()
+	sorted := filepath.Join(dir, "sorted.log")
+	os.WriteFile(sorted, []byte(text), 0o644)
+	// the later half first, which the probes see going backwards
+	lines := strings.SplitAfter(text, "\n")
+	unsorted := filepath.Join(dir, "unsorted.log")
+	os.WriteFile(unsorted, []byte(strings.Join(lines[10000:], "")+strings.Join(lines[:10000], "")), 0o644)
+
+	matcher, err := grep.Compile("", grep.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	windows := [][2]string{{"05:00", "05:10"}, {"", "00:01"}, {"11:00", ""}, {"00:00", "00:00"}, {"23:00", ""}}
+	for _, file := range []string{sorted, unsorted} {
+		for _, bounds := range windows {
+			w := testWindow(t, bounds[0], bounds[1])
+			if f, err := os.Open(file); err == nil {
+				info, _ := f.Stat()
+				if w.sorted(f, info.Size()) != (file == sorted) {
+					t.Errorf("%s: sorted is %v", filepath.Base(file), file != sorted)
+				}
+				f.Close()
+			}
+			got, err := scanWindow(matcher, w, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := filterLines(w, file)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %v: got %d lines, want %d: first %v, want %v",
+					filepath.Base(file), bounds, len(got), len(want), head(got), head(want))
+			}
+		}
+	}
+}
+
+// the numbers of the lines region and keep let through
+func scanWindow(matcher *grep.Matcher, w *window, file string) ([]int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	region, err := w.region(context.Background(), f)
+	if err != nil {
+		return nil, err
+	}
+	var numbers []int
+	_, err = matcher.ScanRegion(context.Background(), f, region, func(line grep.Line) error {
+		numbers = append(numbers, line.Number)
+		return nil
+	})
+	return numbers, err
+}
+
+// the numbers of the lines of file inside w, checked one by one
+func filterLines(w *window, file string) []int {
+	data, _ := os.ReadFile(file)
+	keep := w.keep(false)
+	var numbers []int
+	for i, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if kept, _ := keep([]byte(line)); kept {
+			numbers = append(numbers, i+1)
+		}
+	}
+	return numbers
+}
+
+func head(numbers []int) []int {
+	return numbers[:min(len(numbers), 3)]
+}
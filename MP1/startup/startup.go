@@ -1,89 +1,175 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path"
+	"strings"
 	"sync"
 
 	"golang.org/x/crypto/ssh"
+
+	"gb4/client"
+	"gb4/config"
 )
 
-// runs a given string command on all 10 VMs, authenticated with client config
-func Run(cmd string, config *ssh.ClientConfig) {
+// stops the server on a node: SIGTERM lets it drain running queries (see the
+// server's -drain-timeout), one still running after 45s is killed
+// the server is found by the port it listens on, so servers of other nodes
+// on the same host, as in cluster.local.json, are left alone
+func stopServer(node config.Node) string {
+	// fuser complains about processes of other users it cannot inspect
+	port := node.Port() + "/tcp 2>/dev/null"
+	return "fuser -s -k -TERM " + port + "; " +
+		"for i in $(seq 45); do fuser -s " + port + " || break; sleep 1; done; " +
+		"if fuser -s " + port + "; then fuser -s -k -KILL " + port + "; fi"
+}
+
+// runs a command on the given nodes, authenticated with the ssh client config
+// cmd builds the command for each node, e.g. to pass it its own log sources
+func Run(nodes []config.Node, cmd func(config.Node) string, sshConfig *ssh.ClientConfig) {
 	var wg sync.WaitGroup
 
-	for vmNumber := 1; vmNumber <= 10; vmNumber++ {
+	for _, node := range nodes {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			vm := fmt.Sprintf("fa25-cs425-b4%02d.cs.illinois.edu:22", vmNumber)
-			client, err := ssh.Dial("tcp", vm, config)
+			client, err := ssh.Dial("tcp", node.SSHHost, sshConfig)
 			if err != nil {
-				log.Printf("failed to dial: %v", err)
+				log.Printf("failed to dial %s: %v", node.SSHHost, err)
+				return
 			}
 			defer client.Close()
 
 			session, err := client.NewSession()
 			if err != nil {
 				log.Printf("failed to create session: %v", err)
+				return
 			}
 			defer session.Close()
 
 			session.Stdout = os.Stdout
 			session.Stderr = os.Stderr
 
-			err = session.Run(cmd)
+			err = session.Run(cmd(node))
 
 		}()
 	}
 	wg.Wait()
 }
 
-func ClearLogs(config *ssh.ClientConfig) {
+// removes the log files that belong to other nodes from the given nodes
+// a file the node serves itself, or any node on the same host does, is kept
+// even if another node lists it too, and glob patterns are left alone since
+// they could match anything
+func ClearLogs(cluster *config.Cluster, nodes []config.Node, sshConfig *ssh.ClientConfig) {
 	var wg sync.WaitGroup
 
-	for vmNumber := 1; vmNumber <= 10; vmNumber++ {
+	for _, node := range nodes {
+		paths := foreignLogs(cluster, node)
+		if len(paths) == 0 {
+			continue
+		}
+
 		wg.Add(1)
-		go func(vmNumber int) {
+		go func(node config.Node) {
 			defer wg.Done()
-			vm := fmt.Sprintf("fa25-cs425-b4%02d.cs.illinois.edu:22", vmNumber)
-			client, err := ssh.Dial("tcp", vm, config)
+			client, err := ssh.Dial("tcp", node.SSHHost, sshConfig)
 			if err != nil {
-				log.Printf("failed to dial %s: %v\n", vm, err)
+				log.Printf("failed to dial %s: %v\n", node.SSHHost, err)
 				return
 			}
 			defer client.Close()
 
-			for i := 1; i <= 10; i++ {
-				if i == vmNumber {
-					continue
-				}
+			session, err := client.NewSession()
+			if err != nil {
+				log.Printf("failed to create session: %v", err)
+				return
+			}
+			defer session.Close()
 
-				session, err := client.NewSession()
-				if err != nil {
-					log.Printf("failed to create session: %v", err)
-					continue
-				}
+			session.Stdout = os.Stdout
+			session.Stderr = os.Stderr
+			quoted := make([]string, len(paths))
+			for i, p := range paths {
+				quoted[i] = config.ShellQuote(p)
+			}
+			// source paths are relative to the server directory
+			cmd := fmt.Sprintf("cd %s/server && rm -f -- %s", cluster.RemoteDir, strings.Join(quoted, " "))
 
-				session.Stdout = os.Stdout
-				session.Stderr = os.Stderr
-				cmd := fmt.Sprintf("cd ~/mw128/log && rm -f vm%d.log", i)
+			if err := session.Run(cmd); err != nil {
+				log.Printf("failed to clear logs on %s: %v", node.SSHHost, err)
+			}
+		}(node)
+	}
+	wg.Wait()
+}
 
-				err = session.Run(cmd)
+// the plain file paths other nodes serve that no node on node's host does,
+// in the order they are listed
+func foreignLogs(cluster *config.Cluster, node config.Node) []string {
+	skip := make(map[string]bool)
+	for _, local := range cluster.Nodes {
+		if local.SSHHost != node.SSHHost {
+			continue
+		}
+		for _, src := range local.Sources {
+			for _, p := range src.Paths {
+				skip[path.Clean(p)] = true
+			}
+		}
+	}
 
-				session.Close()
+	var paths []string
+	for _, other := range cluster.Nodes {
+		if other.ID == node.ID {
+			continue
+		}
+		for _, src := range other.Sources {
+			for _, p := range src.Paths {
+				p = path.Clean(p)
+				if skip[p] {
+					continue
+				}
+				skip[p] = true
+				if strings.ContainsAny(p, "*?[") {
+					log.Printf("not clearing %s on node %d, it is a glob pattern", p, node.ID)
+					continue
+				}
+				paths = append(paths, p)
 			}
-		}(vmNumber)
+		}
 	}
-	wg.Wait()
+	return paths
 }
 
 func main() {
+	clusterPath := flag.String("cluster", config.DefaultClusterPath, "path to the cluster file")
 	// custom path needed for each user
-	// perhaps make the keyPath a cmd line arg
-	privateKeyPath := "C:\\Users\\mjwu1\\.ssh\\id_ed25519"
-	privateKey, err := os.ReadFile(privateKeyPath)
+	privateKeyPath := flag.String("key", "C:\\Users\\mjwu1\\.ssh\\id_ed25519", "path to your ssh private key")
+	labelFilter := flag.String("label", "", "only act on nodes with these labels, e.g. role=web,env=lab")
+	flag.Parse()
+
+	cluster, err := config.LoadCluster(*clusterPath)
+	if err != nil {
+		log.Fatalf("error: unable to load cluster: %v", err)
+	}
+
+	labels, err := config.ParseLabels(*labelFilter)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	nodes := cluster.WithLabels(labels)
+
+	// status only talks to the query servers, it needs no ssh key; servers
+	// with an access policy only describe the sources $QUERIER_TOKEN may search
+	if flag.NArg() == 1 && flag.Arg(0) == "status" {
+		os.Exit(client.PrintClusterStatus(cluster, nodes, os.Getenv("QUERIER_TOKEN")))
+	}
+
+	privateKey, err := os.ReadFile(*privateKeyPath)
 
 	if err != nil {
 		log.Fatalf("error: unable to open file")
@@ -95,8 +181,8 @@ func main() {
 		log.Fatalf("error: unable to process key")
 	}
 
-	config := &ssh.ClientConfig{
-		User: "mw128",
+	sshConfig := &ssh.ClientConfig{
+		User: cluster.SSHUser,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
@@ -104,26 +190,28 @@ func main() {
 	}
 
 	// different cmd line args can be passed to execute cmds on all VMs
-	if len(os.Args) == 2 {
-		if os.Args[1] == "wake" {
-			cmd := "pkill -9 server; cd ~/cs-425-mp-1/server && go run server.go"
-			Run(cmd, config)
+	if flag.NArg() == 1 {
+		serverDir := cluster.RemoteDir + "/server"
+		if flag.Arg(0) == "wake" {
+			Run(nodes, func(node config.Node) string {
+				return stopServer(node) + "; cd " + serverDir + " && go run . " + node.ServerArgs()
+			}, sshConfig)
 			return
 		}
-		if os.Args[1] == "pull" {
-			cmd := "cd ~/cs-425-mp-1/server && git fetch origin && git reset --hard origin/main"
-			Run(cmd, config)
+		if flag.Arg(0) == "pull" {
+			Run(nodes, func(config.Node) string {
+				return "cd " + serverDir + " && git fetch origin && git reset --hard origin/main"
+			}, sshConfig)
 			return
 		}
-		if os.Args[1] == "kill" {
-			cmd := "pkill -9 server"
-			Run(cmd, config)
+		if flag.Arg(0) == "kill" {
+			Run(nodes, stopServer, sshConfig)
 			return
 		}
-		if os.Args[1] == "log" {
-			ClearLogs(config)
+		if flag.Arg(0) == "log" {
+			ClearLogs(cluster, nodes, sshConfig)
 			return
 		}
 	}
-	fmt.Println("usage: go run startup.go [ wake | kill | pull | log]")
+	fmt.Println("usage: go run startup.go [-cluster file] [-key file] [-label k=v] [ wake | kill | pull | log | status ]")
 }
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/rpc"
+	"os"
 	"strings"
 	"time"
 	"sync"
 	"math/rand"
+
+	"gb4/api"
+	"gb4/client"
+	"gb4/config"
 )
 
 type TestResult struct {
 	VMNumber  int
 	Pattern   string
 	LineCount int
+	Code      api.Code
 	Output    string
 	Error     error
 	Latency   time.Duration
@@ -20,35 +27,35 @@ type TestResult struct {
 
 type TestSuite struct {
 	clients []*rpc.Client
+	token   string // for servers with an access policy
 }
 
-func NewTestSuite() *TestSuite {
-	// VMV IP ADDRESSES
-	addresses := []string{
-		"172.22.159.124:4425",
-		"172.22.155.198:4425",
-		"172.22.155.125:4425",
-		"172.22.159.125:4425",
-		"172.22.155.199:4425",
-		"172.22.155.126:4425",
-		"172.22.159.126:4425",
-		"172.22.155.200:4425",
-		"172.22.155.127:4425",
-		"172.22.159.127:4425",
+func NewTestSuite(cluster *config.Cluster) *TestSuite {
+	// VM IP ADDRESSES
+	addresses := make([]string, len(cluster.Nodes))
+	for i, node := range cluster.Nodes {
+		addresses[i] = node.Address
 	}
 
 	clients := make([]*rpc.Client, len(addresses))
 	connectedCount := 0
+
+	// TLS if the cluster file asks for it
+	tlsConfig, err := cluster.ClientTLS()
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return &TestSuite{clients: clients}
+	}
 	
 	fmt.Println("=== CONNECTING TO VMs ===")
 	for i, addr := range addresses {
-		client, err := rpc.DialHTTP("tcp", addr)
+		c, err := client.Dial(addr, tlsConfig, 5*time.Second)
 		if err != nil {
 			fmt.Printf("VM %02d: Failed to connect (%s) - %v\n", i + 1, addr, err)
 			clients[i] = nil
 		} else {
 			fmt.Printf("VM %02d: Connected (%s)\n", i + 1, addr)
-			clients[i] = client
+			clients[i] = c
 			connectedCount++
 		}
 	}
@@ -112,6 +119,13 @@ func (ts *TestSuite) executeDistributedGrep(pattern string, isRegex bool) []Test
 	}
 	
 	fmt.Printf("Executing command: %s\n", cmd)
+
+	req, err := api.ParseCommand(cmd)
+	if err != nil {
+		fmt.Printf("ERROR: invalid command: %v\n", err)
+		return nil
+	}
+	req.Token = ts.token
 	
 	var results []TestResult
 	var wg sync.WaitGroup
@@ -132,30 +146,32 @@ func (ts *TestSuite) executeDistributedGrep(pattern string, isRegex bool) []Test
 			}
 			
 			if c == nil {
+				result.Code = api.CodeUnavailable
 				result.Error = fmt.Errorf("VM not available")
 				resultsChan <- result
 				return
 			}
 			
 			start := time.Now()
-			var reply string
-			err := c.Call("VM.Grep", cmd, &reply)
+			var reply api.GrepReply
+			err := c.Call("VM.Search", req, &reply)
 			result.Latency = time.Since(start)
 			
-			if err != nil {
-				if strings.Contains(err.Error(), "no match found") {
-					result.LineCount = 0
-					result.Output = ""
-				} else {
-					result.Error = err
-				}
-			} else {
-				result.Output = reply
-				if reply != "" {
-					result.LineCount = len(strings.Split(strings.TrimSpace(reply), "\n"))
-				} else {
-					result.LineCount = 0
-				}
+			// an RPC error means the VM could not be reached, query
+			// failures come back as a code in the reply
+			result.Code = reply.Code
+			switch {
+			case err != nil:
+				result.Code = api.CodeUnavailable
+				result.Error = err
+			case reply.Code == api.CodeOK:
+				result.Output = reply.Text(req.Options)
+				result.LineCount = len(reply.Matches)
+			case reply.Code == api.CodeNoMatch:
+				result.LineCount = 0
+				result.Output = ""
+			default:
+				result.Error = reply.Err()
 			}
 			
 			resultsChan <- result
@@ -183,11 +199,11 @@ func (ts *TestSuite) analyzeResults(testName string, results []TestResult) {
 	
 	for _, result := range results {
 		if result.Error != nil {
-			if strings.Contains(result.Error.Error(), "not available") {
+			if result.Code == api.CodeUnavailable {
 				fmt.Printf("VM %02d: UNAVAILABLE\n", result.VMNumber + 1)
 				unavailableVMs++
 			} else {
-				fmt.Printf("VM %02d: ERROR - %v\n", result.VMNumber + 1, result.Error)
+				fmt.Printf("VM %02d: ERROR (%s) - %v\n", result.VMNumber + 1, result.Code, result.Error)
 			}
 		} else {
 			fmt.Printf("VM %02d: %d lines matched (latency: %v)\n", 
@@ -382,13 +398,24 @@ func (ts *TestSuite) Close() {
 }
 
 func main() {
+	clusterPath := flag.String("cluster", config.DefaultClusterPath, "path to the cluster file")
+	token := flag.String("token", os.Getenv("QUERIER_TOKEN"), "token for servers with an access policy (default $QUERIER_TOKEN)")
+	flag.Parse()
+
+	cluster, err := config.LoadCluster(*clusterPath)
+	if err != nil {
+		fmt.Printf("ERROR: unable to load cluster: %v\n", err)
+		return
+	}
+
 	rand.Seed(time.Now().UnixNano())
 	
 	fmt.Println("CS425 MP1 - Distributed Log Querier Unit Tests")
 	fmt.Println("=" + strings.Repeat("=", 50))
 	
 	// Create test suite
-	testSuite := NewTestSuite()
+	testSuite := NewTestSuite(cluster)
+	testSuite.token = *token
 	defer testSuite.Close()
 	
 	testSuite.RunDemoTests()